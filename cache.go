@@ -0,0 +1,205 @@
+package compress
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// 压缩结果缓存 实现需要并发安全
+	Cache interface {
+		Get(key string) (CacheEntry, bool)
+		Set(key string, entry CacheEntry)
+	}
+	CacheEntry struct {
+		Status        int
+		Header        http.Header
+		Body          []byte
+		OriginalBytes int64
+		// 按 s-maxage 或 max-age 计算的过期时间 过期后不再使用
+		Expires time.Time
+	}
+
+	// 内存 LRU 缓存
+	LRUCache struct {
+		mutex    sync.Mutex
+		capacity int
+		items    map[string]*list.Element
+		list     *list.List
+	}
+	lruItem struct {
+		key   string
+		entry CacheEntry
+	}
+
+	// 超过 limit 后丢弃内容 不再缓存
+	cacheBuffer struct {
+		bytes.Buffer
+		limit int
+		over  bool
+	}
+)
+
+func NewLRUCache(capacity int) *LRUCache {
+	return &LRUCache{
+		capacity: capacity,
+		items:    map[string]*list.Element{},
+		list:     list.New(),
+	}
+}
+
+func (c *LRUCache) Get(key string) (entry CacheEntry, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var element *list.Element
+	if element, ok = c.items[key]; ok {
+		c.list.MoveToFront(element)
+		entry = element.Value.(*lruItem).entry
+	}
+	return
+}
+
+func (c *LRUCache) Set(key string, entry CacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.items[key]; ok {
+		element.Value.(*lruItem).entry = entry
+		c.list.MoveToFront(element)
+		return
+	}
+	c.items[key] = c.list.PushFront(&lruItem{key: key, entry: entry})
+	for c.capacity > 0 && c.list.Len() > c.capacity {
+		element := c.list.Back()
+		c.list.Remove(element)
+		delete(c.items, element.Value.(*lruItem).key)
+	}
+}
+
+func (c *LRUCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.list.Len()
+}
+
+func (b *cacheBuffer) Write(data []byte) (int, error) {
+	if b.over {
+		return len(data), nil
+	}
+	if b.limit > 0 && b.Len()+len(data) > b.limit {
+		b.over = true
+		b.Reset()
+		return len(data), nil
+	}
+	return b.Buffer.Write(data)
+}
+
+// 缓存键 客户端接受的编码不同结果也不同, 默认包含 scheme 和 Host 不同的站点不共享
+func cacheKey(req *http.Request, config Config, encodings []string) string {
+	var key string
+	if config.CacheKey != nil {
+		key = config.CacheKey(req)
+	} else {
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		key = scheme + "://" + req.Host + req.URL.RequestURI()
+	}
+	if key == "" {
+		return ""
+	}
+	return strings.Join(encodings, ",") + " " + key
+}
+
+// 响应可以缓存的时间 0 表示不缓存
+// 只缓存明确允许共享缓存的响应: Cache-Control 带 public 并且 s-maxage (没有时用 max-age) 大于 0
+// 不缓存 Set-Cookie no-cache no-store private 的响应, Vary 的请求头必须已经包含在缓存键中
+func cacheTTL(status int, header http.Header, config Config) time.Duration {
+	if status != http.StatusOK {
+		return 0
+	}
+	if _, ok := header["Set-Cookie"]; ok {
+		return 0
+	}
+	cacheControl := header.Get("Cache-Control")
+	if !hasToken(cacheControl, "public") || hasToken(cacheControl, "no-cache") || hasToken(cacheControl, "no-store") || hasToken(cacheControl, "private") {
+		return 0
+	}
+	for _, vary := range header["Vary"] {
+		for _, val := range strings.Split(vary, ",") {
+			if !varyInKey(strings.TrimSpace(val), config) {
+				return 0
+			}
+		}
+	}
+	age, ok := directive(cacheControl, "s-maxage")
+	if !ok {
+		age, _ = directive(cacheControl, "max-age")
+	}
+	seconds, err := strconv.ParseInt(age, 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Cache-Control 中 name=value 的值 忽略大小写和引号
+func directive(cacheControl, name string) (string, bool) {
+	for _, val := range strings.Split(cacheControl, ",") {
+		if i := strings.IndexByte(val, '='); i != -1 && strings.EqualFold(strings.TrimSpace(val[:i]), name) {
+			return strings.Trim(strings.TrimSpace(val[i+1:]), `"`), true
+		}
+	}
+	return "", false
+}
+
+// 缓存键包含协商的结果 Accept-Encoding 和转发的编码头都已经区分
+// 按 User-Agent 跳过的请求不会使用缓存, 其他 User-Agent 的结果相同
+func varyInKey(name string, config Config) bool {
+	switch {
+	case name == "":
+		return true
+	case strings.EqualFold(name, "Accept-Encoding"):
+		return true
+	case config.TrustForwardedEncoding && strings.EqualFold(name, config.ForwardedEncodingHeader):
+		return true
+	case len(config.SkipUserAgents) != 0 && strings.EqualFold(name, "User-Agent"):
+		return true
+	}
+	return false
+}
+
+const (
+	// 不限制
+	CacheControlAny CacheControlPolicy = ""
+	// 只压缩共享缓存可以保存的响应 带 private 或 no-store 的不压缩, 没有 Cache-Control 的压缩
+	CacheControlPublic CacheControlPolicy = "public"
+	// 只压缩带 private 或 no-store 的响应 比如共享缓存前面已经有负责压缩的 CDN
+	CacheControlPrivate CacheControlPolicy = "private"
+)
+
+func (policy CacheControlPolicy) allow(cacheControl string) bool {
+	private := hasToken(cacheControl, "private") || hasToken(cacheControl, "no-store")
+	switch policy {
+	case CacheControlPublic:
+		return !private
+	case CacheControlPrivate:
+		return private
+	}
+	return true
+}
+
+func serveCache(w http.ResponseWriter, entry CacheEntry) {
+	header := w.Header()
+	for key, val := range entry.Header {
+		header[key] = append([]string(nil), val...)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	w.WriteHeader(entry.Status)
+	w.Write(entry.Body)
+}
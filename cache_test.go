@@ -0,0 +1,217 @@
+package compress
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/otamoe/gin-compress/compresstest"
+)
+
+func TestCacheHit(t *testing.T) {
+	var calls int
+	config := testConfig()
+	config.Cache = NewLRUCache(8)
+	engine := testEngine(config, func(ctx *gin.Context) {
+		calls++
+		ctx.Header("Cache-Control", "public, max-age=60")
+		ctx.String(http.StatusOK, testBody)
+	})
+
+	for i := 0; i < 3; i++ {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+			t.Fatalf("Content-Encoding = %q, want gzip", val)
+		}
+	}
+	// 接受的编码不同 缓存键不同
+	compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "br"), []byte(testBody))
+	if calls != 2 {
+		t.Fatalf("handler called %d times, want 2", calls)
+	}
+}
+
+func TestLRUCacheEvict(t *testing.T) {
+	cache := NewLRUCache(2)
+	cache.Set("a", CacheEntry{})
+	cache.Set("b", CacheEntry{})
+	cache.Get("a")
+	cache.Set("c", CacheEntry{})
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("b not evicted")
+	}
+	if _, ok := cache.Get("a"); !ok || cache.Len() != 2 {
+		t.Fatal("a evicted")
+	}
+}
+
+// 只缓存明确允许共享缓存并且有过期时间的响应
+func TestCacheOptIn(t *testing.T) {
+	for cacheControl, want := range map[string]time.Duration{
+		"":                                0,
+		"max-age=60":                      0,
+		"public":                          0,
+		"public, max-age=0":               0,
+		"public, no-cache, max-age=60":    0,
+		"public, max-age=60, s-maxage=0":  0,
+		"private, max-age=60":             0,
+		"public, max-age=60":              time.Minute,
+		"Public, Max-Age=\"60\"":          time.Minute,
+		"public, max-age=0, s-maxage=120": 2 * time.Minute,
+	} {
+		cache := NewLRUCache(8)
+		config := testConfig()
+		config.Cache = cache
+		engine := testEngine(config, func(ctx *gin.Context) {
+			ctx.Header("Cache-Control", cacheControl)
+			ctx.String(http.StatusOK, testBody+ctx.GetHeader("X-Api-Key"))
+		})
+
+		req := testRequest("GET", "/me", "gzip")
+		req.Header.Set("X-Api-Key", "alice")
+		start := time.Now()
+		compresstest.AssertRoundTrip(t, engine, req, []byte(testBody+"alice"))
+		if want == 0 {
+			if cache.Len() != 0 {
+				t.Fatalf("%q: cached", cacheControl)
+			}
+			compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/me", "gzip"), []byte(testBody))
+			continue
+		}
+		for _, element := range cache.items {
+			if expires := element.Value.(*lruItem).entry.Expires; expires.Before(start.Add(want)) || expires.After(time.Now().Add(want)) {
+				t.Fatalf("%q: expires in %s, want %s", cacheControl, expires.Sub(start), want)
+			}
+		}
+		compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/me", "gzip"), []byte(testBody+"alice"))
+	}
+}
+
+// 不同站点和 scheme 不共享缓存, 过期的缓存不再使用
+func TestCacheScope(t *testing.T) {
+	var calls int
+	cache := NewLRUCache(8)
+	config := testConfig()
+	config.Cache = cache
+	engine := testEngine(config, func(ctx *gin.Context) {
+		calls++
+		ctx.Header("Cache-Control", "public, max-age=60")
+		ctx.String(http.StatusOK, testBody+ctx.Request.Host)
+	})
+	for _, target := range []string{"http://a.example/", "http://b.example/", "https://a.example/", "http://a.example/"} {
+		req := testRequest("GET", target, "gzip")
+		if req.URL.Scheme == "https" {
+			req.TLS = &tls.ConnectionState{}
+		}
+		compresstest.AssertRoundTrip(t, engine, req, []byte(testBody+req.Host))
+	}
+	if calls != 3 || cache.Len() != 3 {
+		t.Fatalf("handler called %d times, %d cached", calls, cache.Len())
+	}
+
+	for key, element := range cache.items {
+		entry := element.Value.(*lruItem).entry
+		entry.Expires = time.Now().Add(-time.Second)
+		cache.Set(key, entry)
+	}
+	compresstest.AssertRoundTrip(t, engine, testRequest("GET", "http://a.example/", "gzip"), []byte(testBody+"a.example"))
+	if calls != 4 {
+		t.Fatalf("handler called %d times, want 4", calls)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	var calls int
+	config := testConfig()
+	config.Cache = NewLRUCache(8)
+	engine := testEngine(config, func(ctx *gin.Context) {
+		calls++
+		ctx.Header("Cache-Control", "public, max-age=60")
+		ctx.Header("Vary", "Origin")
+		ctx.String(http.StatusOK, testBody)
+	})
+	for i := 0; i < 2; i++ {
+		compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	}
+	if calls != 2 {
+		t.Fatalf("handler called %d times, want 2", calls)
+	}
+}
+
+func TestCachePerRequest(t *testing.T) {
+	config := testConfig()
+	config.Cache = NewLRUCache(8)
+	config.PerRequest = func(ctx *gin.Context) *Config {
+		if ctx.Query("tenant") == "" {
+			return nil
+		}
+		override := testConfig()
+		override.Cache = config.Cache
+		return &override
+	}
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Header("Cache-Control", "public, max-age=60")
+		ctx.String(http.StatusOK, testBody+ctx.Query("tenant"))
+	})
+
+	compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/?tenant=a", "gzip"), []byte(testBody+"a"))
+	compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/?tenant=a", "gzip"), []byte(testBody+"a"))
+	if cache := config.Cache.(*LRUCache); cache.Len() != 0 {
+		t.Fatalf("cached %d per request responses", cache.Len())
+	}
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, testRequest("GET", "/", "gzip"))
+	if cache := config.Cache.(*LRUCache); cache.Len() != 1 {
+		t.Fatalf("cached %d responses, want 1", cache.Len())
+	}
+}
+
+func TestCacheControlPolicy(t *testing.T) {
+	for policy, want := range map[CacheControlPolicy]map[string]string{
+		CacheControlAny: {
+			"":                   "gzip",
+			"public, max-age=60": "gzip",
+			"private":            "gzip",
+			"no-store":           "gzip",
+		},
+		CacheControlPublic: {
+			"":                   "gzip",
+			"public, max-age=60": "gzip",
+			"private":            "",
+			"no-store":           "",
+		},
+		CacheControlPrivate: {
+			"":                    "",
+			"public, max-age=60":  "",
+			"private":             "gzip",
+			"max-age=0, no-store": "gzip",
+		},
+	} {
+		var stats CompressStats
+		config := testConfig()
+		config.CacheControlPolicy = policy
+		config.OnComplete = func(val CompressStats) {
+			stats = val
+		}
+		engine := testEngine(config, func(ctx *gin.Context) {
+			if val := ctx.Query("cc"); val != "" {
+				ctx.Header("Cache-Control", val)
+			}
+			ctx.String(http.StatusOK, testBody)
+		})
+		for cacheControl, encoding := range want {
+			recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/?cc="+url.QueryEscape(cacheControl), "gzip"), []byte(testBody))
+			if val := recorder.Header().Get("Content-Encoding"); val != encoding {
+				t.Fatalf("%q %q: Content-Encoding = %q, want %q", policy, cacheControl, val, encoding)
+			}
+			if encoding == "" && stats.SkipReason != SkipCacheControl {
+				t.Fatalf("%q %q: skip reason %q", policy, cacheControl, stats.SkipReason)
+			}
+		}
+	}
+}
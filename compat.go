@@ -0,0 +1,81 @@
+package compress
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type (
+	// 兼容 gin-contrib/gzip 的选项
+	Option  func(*options)
+	options struct {
+		excludedExtensions []string
+		excludedPaths      []string
+		excludedPathRegexs []*regexp.Regexp
+	}
+)
+
+// 兼容 gin-contrib/gzip 的 gzip.Gzip(level, options...) 只使用 gzip
+// 默认排除 .png .gif .jpeg .jpg, 需要 brotli 等请使用 Compress
+func Gzip(level int, opts ...Option) gin.HandlerFunc {
+	options := &options{
+		excludedExtensions: []string{".png", ".gif", ".jpeg", ".jpg"},
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	handler := Compress(Config{
+		Types:             append([]string(nil), DefaultTypes...),
+		GzipLevel:         level,
+		DisableBrotli:     true,
+		Methods:           []string{"*"},
+		ExcludeExtensions: options.excludedExtensions,
+	})
+	return func(ctx *gin.Context) {
+		if options.excluded(ctx.Request.URL.Path) {
+			ctx.Next()
+			return
+		}
+		handler(ctx)
+	}
+}
+
+// 排除的扩展名 替换默认值
+func WithExcludedExtensions(extensions []string) Option {
+	return func(o *options) {
+		o.excludedExtensions = append([]string(nil), extensions...)
+	}
+}
+
+// 排除的路径前缀
+func WithExcludedPaths(paths []string) Option {
+	return func(o *options) {
+		o.excludedPaths = append(o.excludedPaths, paths...)
+	}
+}
+
+// 排除的路径正则 不合法时 panic
+func WithExcludedPathsRegexs(regexs []string) Option {
+	return func(o *options) {
+		for _, regex := range regexs {
+			o.excludedPathRegexs = append(o.excludedPathRegexs, regexp.MustCompile(regex))
+		}
+	}
+}
+
+func (o *options) excluded(path string) bool {
+	for _, val := range o.excludedPaths {
+		if strings.HasPrefix(path, val) {
+			return true
+		}
+	}
+	for _, val := range o.excludedPathRegexs {
+		if val.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package compress
+
+import (
+	"compress/gzip"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/otamoe/gin-compress/compresstest"
+)
+
+func TestGzipCompat(t *testing.T) {
+	engine := gin.New()
+	engine.Use(Gzip(gzip.DefaultCompression, WithExcludedPaths([]string{"/api/raw"}), WithExcludedPathsRegexs([]string{`^/static/.*\.txt$`})))
+	engine.Any("/*path", stringHandler(testBody))
+
+	for target, want := range map[string]string{
+		"/":               "gzip",
+		"/a.css":          "gzip",
+		"/a.png":          "",
+		"/a.JPG":          "",
+		"/api/raw/1":      "",
+		"/static/a.txt":   "",
+		"/static/a.html":  "gzip",
+		"/api/rawer/data": "",
+	} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, "br, gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", target, val, want)
+		}
+	}
+
+	// gin-contrib/gzip 压缩所有方法
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("POST", "/", "gzip"), []byte(testBody))
+	if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+		t.Fatalf("POST Content-Encoding = %q, want gzip", val)
+	}
+}
+
+func TestGzipCompatExcludedExtensions(t *testing.T) {
+	engine := gin.New()
+	engine.Use(Gzip(gzip.DefaultCompression, WithExcludedExtensions([]string{".txt"})))
+	engine.Any("/*path", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, testBody)
+	})
+	for target, want := range map[string]string{
+		"/a.txt": "",
+		"/a.png": "gzip",
+	} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", target, val, want)
+		}
+	}
+}
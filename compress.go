@@ -1,180 +1,1626 @@
 package compress
 
 import (
+	"compress/flate"
 	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"mime"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/brotli/go/cbrotli"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
 )
 
+// 压缩的响应结束后继续写入 没有压缩的响应结束后的写入直接发送
+var ErrWriteAfterClose = errors.New("gin-compress: write after close")
+
 type (
+	// recovery 等错误处理中间件需要注册在 Compress 之后 (内层), 写入的错误响应才会压缩
+	// 注册在 Compress 之前时 panic 已经结束了压缩, 之后写入的错误响应不压缩直接输出
 	Config struct {
-		Types     []string
-		MinLength int64
-		BrQuality int
-		BrLGWin   int
+		// 需要压缩的媒体类型 精确匹配, 为空时使用 DefaultTypes
+		// multipart/* 通常混有二进制内容 只有显式列出具体类型时才会压缩整个流
+		// application/x-protobuf 等可压缩的二进制类型不在 DefaultTypes 中, 需要时显式加入
+		// "*" 或 "*/*" 匹配 IncompressibleTypes 之外的所有类型, 未知的二进制类型也会压缩 只是浪费 CPU
+		Types []string
+		// 不超过 MinLength 不压缩, 没有 Content-Length 时先缓存分次写入的内容 超过或结束时再决定
+		// 缓存超过 MaxBufferBytes (默认 1MB) 时按长度未知的流处理, 缓存压缩结果时超过同样不再缓存
+		MinLength      int64
+		MaxBufferBytes int64
+		BrQuality      int
+		BrLGWin        int
+		// 0 (未设置) 按 gzip.DefaultCompression 处理, 不支持 gzip.NoCompression, 不需要 gzip 时使用 DisableGzip
 		GzipLevel int
+
+		// 自定义的 brotli 编码器 比如纯 Go 的实现或测试使用的 mock, 为 nil 时使用 cbrotli; 返回 nil 按创建失败处理
+		// quality lgwin 为应用了动态内容上限和 BrLGWinDynamic 之后的值; 包仍然依赖 cbrotli, 需要 cgo
+		BrotliWriterFactory func(w io.Writer, quality, lgwin int) io.WriteCloser
+
+		// 自定义的 gzip 编码器 比如 klauspost/compress/gzip, 为 nil 时使用标准库并复用池; 出错时不压缩
+		// 每个响应调用一次 不经过池, 需要复用时在工厂里自己实现; Timeout 降级不对工厂创建的 writer 生效
+		GzipWriterFactory func(w io.Writer, level int) (io.WriteCloser, error)
+
+		// 按同时进行的 brotli 压缩数量缩小窗口 减少高并发时编码器的内存
+		// 不超过 16 个时使用 BrLGWin (0 按 22 计算), 之后数量每翻一倍窗口减 1, 最小 18; 窗口越小压缩率越低
+		BrLGWinDynamic bool
+
+		// zstd 默认不协商 需要开启 ZstdLevel 为 zstd 标准级别 0 使用默认级别
+		// ZstdDict 为 zstd --train 生成的字典, 客户端必须持有相同的字典, 只适用于可控的客户端和服务端
+		EnableZstd bool
+		ZstdLevel  int
+		ZstdDict   []byte
+
+		// Content-Type 为 application/octet-stream 时用第一次写入的内容 (最多 512 字节) 嗅探类型
+		// 嗅探出的类型在 Types 中时压缩 并把 Content-Type 改为嗅探出的类型, 内容不变
+		SniffOverrideOctetStream bool
+
+		// 压缩前用 s2 快速压缩第一次写入内容的前 4096 字节估算压缩率, 超过 90% 时不压缩
+		// 比如 base64 编码的二进制等匹配文本类型的高熵内容, 少于 256 字节时样本不够不检查
+		EntropyCheck bool
+
+		// 非标准的 x-snappy-framed 编码 只适合两端都可控的服务间调用, 开启后优先于其他编码
+		EnableSnappy bool
+
+		// 动态内容 (不可缓存) 的 brotli 最高质量 0 不限制, 高质量的耗时无法像静态内容一样分摊
+		// Dynamic 判断响应是否为动态内容, 默认没有 Cache-Control 或不允许缓存 (no-store no-cache private max-age=0) 时为动态
+		BrotliMaxQualityForDynamic int
+		Dynamic                    func(req *http.Request, header http.Header) bool
+
+		// 同时接受 br 和 gzip 且声明了 Content-Length 时 小于 AdaptiveThreshold (默认 1024) 使用 gzip
+		// 没有声明长度时不切换, 模板等分多次写入的响应第一次写入的长度不代表总长度
+		// 小内容 brotli 的头和上下文开销可能比 gzip 更大
+		AdaptiveCodec     bool
+		AdaptiveThreshold int64
+
+		// 按媒体类型 (小写 不含参数) 选择编码 比如 application/json 使用更便宜的 gzip, 优先于 AdaptiveCodec
+		// 只在客户端接受且启用时使用, 否则按正常的优先级
+		CodecByType map[string]string
+
+		// 把非标准的 x-br 当作 br 协商 响应始终使用 br
+		AcceptLegacyBrotliToken bool
+
+		// 禁用的编码即使客户端支持也不会协商
+		DisableGzip   bool
+		DisableBrotli bool
+		// 只在 TLS 连接 (req.TLS 不为 nil) 上协商 brotli, 避免明文经过的代理损坏内容
+		// 在反向代理上终止 TLS 时 req.TLS 始终为 nil, 开启后不会再使用 brotli
+		BrotliRequireTLS bool
+
+		// 单个响应的压缩耗时上限 超过后剩余内容在同一个 gzip 成员中以不压缩的 stored block 输出
+		// 头已经发送无法撤销编码, 只对后续未写入的内容有效; brotli 无法中途切换不受影响
+		Timeout time.Duration
+
+		// User-Agent 包含其中任意字符串时不压缩
+		SkipUserAgents []string
+
+		// 压缩的请求方法 默认 GET 和 HEAD, * 表示全部 (OPTIONS 除外)
+		Methods []string
+
+		// 只在实际压缩的响应 (以及和 GET 一致的 HEAD) 上设置 Vary, 跳过的响应不设置
+		// 同一个 URL 有时压缩有时不压缩 (比如按长度) 时, 没有 Vary 的未压缩响应可能被共享缓存返回给所有客户端
+		// 只适用于按 URL 就能确定是否压缩的内容, 比如图片
+		VaryOnlyWhenCompressed bool
+
+		// 请求路径以这些扩展名结尾时不压缩 比如 .png .zip, 不区分大小写
+		ExcludeExtensions []string
+
+		// 压缩长度未知的流 (Content-Length 为负数)
+		// SSE 和 NDJSON 本身就是逐条发送的流 不受这个选项和 MinLength 限制, 只要类型匹配就压缩
+		CompressUnknownLength bool
+
+		// 信任代理转发的原始 Accept-Encoding 头 (CDN 等解压代理之后)
+		TrustForwardedEncoding  bool
+		ForwardedEncodingHeader string
+
+		// 调试模式 跳过压缩时设置 X-Compress-Skip 头说明原因
+		// X-Compress-Negotiation 说明协商结果 比如 offered=br,gzip; chosen=br, offered 为客户端接受的编码 (q>0)
+		// X-Compress-Info 为实际使用的参数 比如 br;q=5;lgwin=22 或 gzip;level=6, 已经应用动态内容的质量上限等调整
+		// 压缩时设置 X-Compress-Original-Size 和 X-Compress-Encoded-Size, 压缩结果暂存在内存中结束时作为头发送
+		// 超过 MaxBufferBytes 或刷新时改为 trailer 发送
+		Debug bool
+
+		// 默认压缩后长度未知 HTTP/1.1 使用 chunked, 处理函数结束时 net/http 还没发送的 (不超过 2KB) 由 net/http 设置 Content-Length
+		// 压缩后的内容暂存在内存中 结束时设置准确的 Content-Length, 不使用 chunked
+		// 用于不接受 chunked 压缩响应的客户端; 超过 MaxBufferBytes, 刷新后或声明了 trailer 时改为 chunked 发送
+		AlwaysContentLength bool
+
+		// 默认不压缩 HTTP/1.0 的请求, 开启后和 AlwaysContentLength 一样暂存压缩结果设置 Content-Length 保持连接
+		// HTTP/1.0 没有 chunked, 超过 MaxBufferBytes 或刷新后由 net/http 关闭连接表示结束
+		AllowHTTP10 bool
+
+		// 按压缩后的内容设置弱 ETag W/"<hash>-<编码>" 覆盖处理函数设置的, 每种编码的 ETag 不同
+		// If-None-Match 匹配时返回 304 不发送内容; 只处理 200 的 GET, 同样暂存压缩结果, 超过 MaxBufferBytes 或刷新后不设置
+		ETag bool
+
+		// 只统计不压缩 用于开启前估算节省的流量, 按正常流程决定是否压缩和编码, 压缩的输出丢弃只计数
+		// 响应原样发送 不修改头 (不设置 Vary), OnComplete 的 CompressedBytes 为压缩后的大小, DryRun 为 true
+		// Debug 时设置 X-Compress-Dry-Run 为会使用的参数; 不使用 Cache 和 Transcode
+		DryRun bool
+
+		// 客户端优先 brotli 时 把处理函数 (比如 ReverseProxy 的上游) 已经 gzip 的 GET 响应解码后用 brotli 重新压缩
+		// 只处理不超过 TranscodeMaxBytes (默认 128KB) 的 gzip 内容, 解码后超过 MaxBufferBytes 或解码失败时原样输出
+		// 需要暂存完整的响应 刷新时放弃转码; 解码和重新压缩都消耗 CPU, 只适用于小的可缓存内容
+		Transcode         bool
+		TranscodeMaxBytes int64
+
+		// 日志 比如 log.Printf
+		Logger func(format string, args ...interface{})
+
+		// 第一次写入时用请求和响应头判断是否压缩 返回 false 不压缩 比如按路由关闭
+		// 也是 BREACH 的逃生口: 同时包含秘密 (CSRF token 等) 和请求中可控内容的响应应该返回 false
+		ShouldCompress func(req *http.Request, header http.Header) bool
+
+		// BREACH 缓解 响应设置名字包含 csrf 或 xsrf 的 cookie 时不压缩
+		// 只能发现通过 Set-Cookie 下发的 token, 无法判断内容中是否反射了秘密和请求参数;
+		// 页面中嵌入的 token 需要通过 ShouldCompress 排除或者每次请求掩码 token
+		BreachMitigation bool
+
+		// compressWriter 和压缩器都不是并发安全的, 处理函数在多个 goroutine 中写入 ctx.Writer 时需要开启
+		// 开启后 Write Flush 和结束时的关闭使用同一个锁; 只保证写入不交错, 写入的顺序由处理函数自己同步
+		// 所有 goroutine 必须在处理函数返回之前写完, 之后的写入返回 ErrWriteAfterClose; Header() 的并发修改不受保护
+		ConcurrentSafe bool
+
+		// 返回 true 时完全跳过中间件 不包装 writer 也不设置 Vary, 比如大文件导出; 只对 Compress 有效
+		Skip func(ctx *gin.Context) bool
+
+		// 返回单个请求使用的配置 nil 使用当前配置, 比如按租户或登录状态调整质量和类型
+		// 返回的配置不合法时记录日志并使用当前配置
+		PerRequest func(ctx *gin.Context) *Config
+
+		// 缓存压缩结果 只缓存 GET 的 200 响应, 并且响应需要明确允许共享缓存: Cache-Control 带 public 和大于 0 的 s-maxage 或 max-age
+		// 按 s-maxage 或 max-age 过期, 不缓存带 Set-Cookie 或 Cache-Control: no-cache/no-store/private 的响应, Vary 了其他请求头的响应不缓存
+		// PerRequest 返回覆盖配置的请求不使用缓存
+		// 命中时直接返回缓存的响应, 不执行处理函数以及 Compress 之后的所有中间件 (包括鉴权), 只应用于对所有请求都相同的公开内容
+		// CacheKey 返回空字符串表示不缓存, 默认使用 scheme Host 和 RequestURI
+		// CacheMaxBytes 单个响应压缩后的最大缓存字节数 0 使用 MaxBufferBytes
+		Cache         Cache
+		CacheKey      func(req *http.Request) string
+		CacheMaxBytes int
+
+		// 按响应的 Cache-Control 决定是否压缩 默认不限制, 见 CacheControlPublic 和 CacheControlPrivate
+		CacheControlPolicy CacheControlPolicy
+
+		// 创建时预先放入池中的 writer 数量 避免空闲后的突发请求集中分配
+		// brotli 不使用池; sync.Pool 可能在 GC 时回收, 只用于减少启动和突发时的分配
+		PrewarmPool int
+		// 每个池 (每种编码和压缩级别) 最多保留的 writer 数量, 超出的结束后直接丢弃; 0 不限制使用 sync.Pool
+		// 限制时保留的 writer 不会在 GC 时回收, 内存上限约为数量乘以单个 writer 的缓冲
+		MaxPooledWriters int
+
+		// 完成回调 可用于导出 prometheus 等指标, Compress 中同样可以在结束后通过 Stats(ctx) 读取
+		OnComplete func(stats CompressStats)
+
+		// 压缩结束后调用 每个经过中间件的请求调用一次 (包括没有写入内容和 panic), 用于释放自定义的资源
+		// 只对 Compress 有效, Skip 返回 true 的请求不调用
+		OnClose func(ctx *gin.Context)
+	}
+	CacheControlPolicy string
+
+	compressor struct {
+		config     Config
+		gzipPools  sync.Map // 压缩级别 -> *writerPool
+		zstdPools  sync.Map // 压缩级别 -> *writerPool
+		snappyPool *writerPool
+		bufferPool sync.Pool // *[]byte 容量为 MinLength
+		brotli     int64     // 正在进行的 brotli 压缩数量 atomic
 	}
 	compressWriter struct {
 		gin.ResponseWriter
-		writer   io.Writer
-		request  *http.Request
-		config   Config
-		encoding string
-		gzipPool *sync.Pool
+		writer           io.Writer
+		request          *http.Request
+		config           Config
+		encoding         string
+		encodings        []string
+		offered          []string // 客户端接受的编码 调试模式使用
+		gzipPool         *writerPool
+		zstdPool         *writerPool
+		snappyPool       *writerPool
+		counter          countWriter
+		stats            CompressStats
+		timeout          bool
+		crc              uint32 // Timeout 时 gzip 已写入内容的 CRC-32, 降级后由 storedGzip 写入结尾
+		opened           bool
+		closed           bool
+		cacheKey         string
+		cache            *cacheBuffer
+		contentLength    string // setHeader 去掉的 Content-Length
+		acceptRanges     string // setHeader 去掉的 Accept-Ranges
+		transferEncoding string // setHeader 去掉的 Transfer-Encoding
+		hold             *holdWriter
+		bufferPool       *sync.Pool
+		buffer           *[]byte
+		sniff            []byte // open 时第一次写入的内容
+		transcode        *transcodeBuffer
+		info             string     // 实际使用的编码参数 调试模式使用
+		mu               sync.Mutex // ConcurrentSafe
+		vary             []string   // VaryOnlyWhenCompressed 时 setHeader 之前的 Vary
+		varySet          bool
+		brotli           *int64 // compressor.brotli
+		// 当前的压缩器 close 时关闭, release 放回取出的池 (工厂创建的为 nil)
+		codec     io.WriteCloser
+		release   func()
+		headerNow bool // WriteHeaderNow 推迟到第一次写入
 	}
 )
 
+// 返回的 handler 可以同时挂到多个 gin.Engine 上
+// 闭包内的状态只有只读的 config 和并发安全的 sync.Pool sync.Map, Cache 和回调需要使用方保证并发安全
 func Compress(config Config) gin.HandlerFunc {
-	gzipPool := &sync.Pool{
-		New: func() interface{} {
-			writer, err := gzip.NewWriterLevel(ioutil.Discard, config.GzipLevel)
-			if err != nil {
-				panic(err)
-			}
-			return writer
-		},
-	}
-
+	compressor := newCompressor(config)
 	return func(ctx *gin.Context) {
-		encoding := getEncoding(ctx.Request)
-		vary := ctx.Writer.Header().Get("Vary")
-		if vary == "" {
-			vary = "Accept-Encoding"
-		} else {
-			vary += ", Accept-Encoding"
-		}
-		ctx.Header("Vary", vary)
-		// 没有编码
-		if encoding == "" {
+		config := compressor.config
+		if config.Skip != nil && config.Skip(ctx) {
 			ctx.Next()
 			return
 		}
-
-		writer := &compressWriter{
-			ResponseWriter: ctx.Writer,
-			writer:         ctx.Writer,
-			request:        ctx.Request,
-			config:         config,
-			encoding:       encoding,
-			gzipPool:       gzipPool,
+		if config.PerRequest != nil {
+			if override := config.PerRequest(ctx); override != nil {
+				config = compressor.override(*override)
+			}
 		}
+		// 结束时把统计写入 ctx, 之后由 Stats 读取
+		onComplete := config.OnComplete
+		config.OnComplete = func(stats CompressStats) {
+			ctx.Set(StatsKey, stats)
+			if onComplete != nil {
+				onComplete(stats)
+			}
+		}
+		original := ctx.Writer
+		writer, finish, handled := compressor.wrap(original, ctx.Request, config)
 		ctx.Writer = writer
-		defer writer.close()
+		// panic 时还原 writer, 外层的 recovery 之后写入的错误内容不压缩直接输出
+		// 正常结束保留 compressWriter, 外层中间件可以读取 OriginalSize 等
+		var done bool
+		defer func() {
+			finish()
+			if !done {
+				ctx.Writer = original
+			}
+			if config.OnClose != nil {
+				config.OnClose(ctx)
+			}
+		}()
+		if handled {
+			ctx.Abort()
+			done = true
+			return
+		}
 		ctx.Next()
+		done = true
+	}
+}
+
+// 挂载到路由组 返回原路由组方便链式调用, 配置错误和 Compress 一样直接 panic
+func Use(group gin.IRoutes, config Config) gin.IRoutes {
+	return group.Use(Compress(config))
+}
+
+// 包装普通的 http.ResponseWriter 可以在 gin 之外使用, 处理完成后必须调用返回的函数
+// 每次调用都会创建新的 writer 池, 需要复用请使用 Handler; 不支持 Cache
+func NewWriter(w http.ResponseWriter, req *http.Request, config Config) (http.ResponseWriter, func()) {
+	config.Cache = nil
+	writer, finish, _ := newCompressor(config).newWriter(w, req)
+	return writer, finish
+}
+
+// 标准库 http.Handler 中间件
+func Handler(config Config) func(http.Handler) http.Handler {
+	compressor := newCompressor(config)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			writer, finish, handled := compressor.newWriter(w, req)
+			defer finish()
+			if !handled {
+				next.ServeHTTP(writer, req)
+			}
+		})
+	}
+}
+
+func newCompressor(config Config) *compressor {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+
+	c := &compressor{
+		config: normalizeConfig(config),
+		snappyPool: newWriterPool(config.MaxPooledWriters, func() interface{} {
+			return s2.NewWriter(nil, s2.WriterSnappyCompat(), s2.WriterConcurrency(1))
+		}),
+	}
+	c.bufferPool.New = func() interface{} {
+		size := c.config.MinLength
+		if size > c.config.MaxBufferBytes {
+			size = c.config.MaxBufferBytes
+		}
+		buffer := make([]byte, 0, size)
+		return &buffer
+	}
+	c.prewarm(c.config.PrewarmPool)
+	return c
+}
+
+// 预先创建 writer 只预热会协商到的编码
+func (c *compressor) prewarm(n int) {
+	pools := []*writerPool{}
+	if !c.config.DisableGzip && c.config.GzipWriterFactory == nil {
+		pools = append(pools, c.gzipPool(c.config.GzipLevel))
+	}
+	if c.config.EnableZstd {
+		pools = append(pools, c.zstdPool(c.config.ZstdLevel))
+	}
+	if c.config.EnableSnappy {
+		pools = append(pools, c.snappyPool)
+	}
+	for _, pool := range pools {
+		for i := 0; i < n; i++ {
+			pool.Put(pool.New())
+		}
+	}
+}
+
+func normalizeConfig(config Config) Config {
+	// 复制切片 防止外部修改原 config 影响已创建的 handler
+	// 类型统一小写 mime.ParseMediaType 返回的也是小写
+	if len(config.Types) == 0 {
+		config.Types = DefaultTypes
+	}
+	types := make([]string, len(config.Types))
+	for i, typ := range config.Types {
+		types[i] = strings.ToLower(strings.TrimSpace(typ))
+	}
+	config.Types = types
+	config.SkipUserAgents = append([]string(nil), config.SkipUserAgents...)
+	extensions := make([]string, 0, len(config.ExcludeExtensions))
+	for _, extension := range config.ExcludeExtensions {
+		extension = strings.ToLower(strings.TrimSpace(extension))
+		if extension == "" {
+			continue
+		}
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		extensions = append(extensions, extension)
+	}
+	config.ExcludeExtensions = extensions
+	methods := make([]string, 0, len(config.Methods))
+	for _, method := range config.Methods {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			methods = append(methods, method)
+		}
+	}
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead}
+	}
+	config.Methods = methods
+	config.ZstdDict = append([]byte(nil), config.ZstdDict...)
+	if config.CodecByType != nil {
+		codecs := make(map[string]string, len(config.CodecByType))
+		for typ, codec := range config.CodecByType {
+			codecs[strings.ToLower(strings.TrimSpace(typ))] = codec
+		}
+		config.CodecByType = codecs
+	}
+	if config.GzipLevel == gzip.NoCompression {
+		config.GzipLevel = gzip.DefaultCompression
+	}
+	if config.AdaptiveThreshold == 0 {
+		config.AdaptiveThreshold = 1024
+	}
+	if config.MaxBufferBytes == 0 {
+		config.MaxBufferBytes = 1 << 20
+	}
+	if config.TranscodeMaxBytes == 0 {
+		config.TranscodeMaxBytes = 128 << 10
+	}
+	if config.ForwardedEncodingHeader == "" {
+		config.ForwardedEncodingHeader = "X-Original-Accept-Encoding"
+	}
+	return config
+}
+
+// 单个请求的覆盖配置 错误时使用基础配置
+// ZstdDict 和 PerRequest 始终使用基础配置, Logger OnComplete OnClose ShouldCompress 和编码器工厂为 nil 时使用基础配置
+// 不使用 Cache
+func (c *compressor) override(config Config) Config {
+	config.ZstdDict = nil
+	if err := config.Validate(); err != nil {
+		if c.config.Logger != nil {
+			c.config.Logger("gin-compress: per request config: %v", err)
+		}
+		return c.config
+	}
+	config = normalizeConfig(config)
+	config.ZstdDict = c.config.ZstdDict
+	config.PerRequest = c.config.PerRequest
+	if config.Logger == nil {
+		config.Logger = c.config.Logger
+	}
+	// 缓存键不区分配置 覆盖配置生成的结果不能给其他请求使用
+	config.Cache = nil
+	if config.OnComplete == nil {
+		config.OnComplete = c.config.OnComplete
+	}
+	if config.OnClose == nil {
+		config.OnClose = c.config.OnClose
+	}
+	if config.ShouldCompress == nil {
+		config.ShouldCompress = c.config.ShouldCompress
+	}
+	if config.BrotliWriterFactory == nil {
+		config.BrotliWriterFactory = c.config.BrotliWriterFactory
+	}
+	if config.GzipWriterFactory == nil {
+		config.GzipWriterFactory = c.config.GzipWriterFactory
+	}
+	return config
+}
+
+// 按压缩级别复用 gzip writer
+func (c *compressor) gzipPool(level int) *writerPool {
+	if pool, ok := c.gzipPools.Load(level); ok {
+		return pool.(*writerPool)
+	}
+	pool, _ := c.gzipPools.LoadOrStore(level, newWriterPool(c.config.MaxPooledWriters, func() interface{} {
+		writer, err := gzip.NewWriterLevel(ioutil.Discard, level)
+		if err != nil {
+			panic(err)
+		}
+		// 标准库第一次写入时才分配 flate 压缩器和历史缓冲, 这里提前分配 PrewarmPool 才有效果
+		writer.Write(nil)
+		writer.Flush()
+		writer.Reset(ioutil.Discard)
+		return writer
+	}))
+	return pool.(*writerPool)
+}
+
+// 按压缩级别复用 zstd encoder
+func (c *compressor) zstdPool(level int) *writerPool {
+	if pool, ok := c.zstdPools.Load(level); ok {
+		return pool.(*writerPool)
+	}
+	options := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	if level != 0 {
+		options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	if len(c.config.ZstdDict) != 0 {
+		options = append(options, zstd.WithEncoderDict(c.config.ZstdDict))
+	}
+	pool, _ := c.zstdPools.LoadOrStore(level, newWriterPool(c.config.MaxPooledWriters, func() interface{} {
+		writer, err := zstd.NewWriter(nil, options...)
+		if err != nil {
+			panic(err)
+		}
+		// 和 gzip 一样 编码器的缓冲在第一次压缩时才分配
+		writer.Reset(ioutil.Discard)
+		writer.Write([]byte{0})
+		writer.Flush()
+		writer.Close()
+		writer.Reset(nil)
+		return writer
+	}))
+	return pool.(*writerPool)
+}
+
+func (c *compressor) newWriter(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, func(), bool) {
+	base := &responseWriter{ResponseWriter: w, size: noWritten, status: http.StatusOK}
+	writer, finish, handled := c.wrap(base, req, c.config)
+	return writer, func() {
+		finish()
+		// 没有写入内容时发送状态码 gin 由 engine 负责
+		base.WriteHeaderNow()
+	}, handled
+}
+
+// 不需要压缩时返回原 writer, handled 表示已经从缓存输出 不需要再执行处理函数
+func (c *compressor) wrap(w gin.ResponseWriter, req *http.Request, config Config) (_ gin.ResponseWriter, _ func(), handled bool) {
+	encodings, offered, disabled := negotiate(req, config)
+	var encoding string
+	if len(encodings) != 0 {
+		encoding = encodings[0]
+	}
+	header := w.Header()
+	// 不压缩的方法和排除的扩展名在包装之前检查 和 OPTIONS 一样响应不随 Accept-Encoding 变化
+	method := matchMethod(req.Method, config.Methods)
+	excluded := excludeExtension(req.URL.Path, config.ExcludeExtensions)
+	// OPTIONS 永远不压缩 响应不随 Accept-Encoding 变化 不设置 Vary
+	// VaryOnlyWhenCompressed 时推迟到开始压缩
+	if req.Method != http.MethodOptions && method && !excluded && !config.VaryOnlyWhenCompressed && !config.DryRun {
+		addVary(header, config)
+	}
+	// 开始压缩时改为实际的编码
+	if config.Debug {
+		setNegotiation(header, offered, "identity")
+	}
+	if skipReason := requestSkip(req, config, encoding, disabled); skipReason != "" {
+		if config.Debug {
+			header.Set("X-Compress-Skip", string(skipReason))
+		}
+		return w, func() {
+			if config.OnComplete != nil {
+				config.OnComplete(CompressStats{Skipped: true, SkipReason: skipReason})
+			}
+		}, false
+	}
+
+	// 缓存 只缓存 GET
+	var key string
+	if config.Cache != nil && !config.DryRun && req.Method == http.MethodGet {
+		key = cacheKey(req, config, encodings)
+	}
+	if key != "" {
+		if entry, ok := config.Cache.Get(key); ok && time.Now().Before(entry.Expires) {
+			serveCache(w, entry)
+			return w, func() {
+				if config.OnComplete != nil {
+					config.OnComplete(CompressStats{
+						Encoding:        entry.Header.Get("Content-Encoding"),
+						OriginalBytes:   entry.OriginalBytes,
+						CompressedBytes: int64(len(entry.Body)),
+						Cached:          true,
+					})
+				}
+			}, true
+		}
+	}
+
+	writer := &compressWriter{
+		ResponseWriter: w,
+		request:        req,
+		config:         config,
+		encoding:       encoding,
+		encodings:      encodings,
+		offered:        offered,
+		gzipPool:       c.gzipPool(config.GzipLevel),
+		zstdPool:       c.zstdPool(config.ZstdLevel),
+		snappyPool:     c.snappyPool,
+		bufferPool:     &c.bufferPool,
+		brotli:         &c.brotli,
+	}
+	writer.counter.Writer = w
+	if key != "" {
+		writer.cacheKey = key
+		limit := config.CacheMaxBytes
+		if limit == 0 || int64(limit) > config.MaxBufferBytes {
+			limit = int(config.MaxBufferBytes)
+		}
+		writer.cache = &cacheBuffer{limit: limit}
+		writer.counter.Writer = io.MultiWriter(w, writer.cache)
+	}
+	writer.writer = &writer.counter
+	return writer, writer.close, false
+}
+
+// 只根据请求就能决定的跳过 响应相关的在第一次写入时决定
+func requestSkip(req *http.Request, config Config, encoding string, disabled bool) SkipReason {
+	if !matchMethod(req.Method, config.Methods) {
+		return SkipMethod
+	}
+	if excludeExtension(req.URL.Path, config.ExcludeExtensions) {
+		return SkipExtension
+	}
+	if encoding == "" && disabled {
+		// 客户端接受的编码都被禁用
+		return SkipDisabled
+	}
+	if encoding == "" {
+		// 没有编码
+		return SkipNoEncoding
+	}
+	if skipUserAgent(req.UserAgent(), config.SkipUserAgents) {
+		// 不支持压缩的客户端
+		return SkipUserAgent
+	}
+	return ""
+}
+
+// 中间件对这个请求会使用的编码 不压缩时为空, 不需要 writer 没有副作用, 可用于选择预先压缩的 .br .gz 文件
+// 和中间件一样按请求头协商 (q 值高的优先) 并检查 Methods ExcludeExtensions SkipUserAgents, 不执行 Skip 和 PerRequest
+// 响应相关的条件 (类型 长度等) 以及 AdaptiveCodec CodecByType 在写入时才能决定, 不在结果中
+func PreferredEncoding(req *http.Request, config Config) string {
+	config = normalizeConfig(config)
+	encodings, _, disabled := negotiate(req, config)
+	var encoding string
+	if len(encodings) != 0 {
+		encoding = encodings[0]
+	}
+	if requestSkip(req, config, encoding, disabled) != "" {
+		return ""
+	}
+	return encoding
+}
+
+// 反向代理缓存键中的编码部分, 和 PreferredEncoding 相同 不压缩时为 identity
+// 等价的 Accept-Encoding (大小写 顺序 q 值 x-gzip 等同义词) 得到相同的结果
+// 响应时 CodecByType AdaptiveCodec 可能改用其他编码, 使用这些选项时缓存还需要按 Content-Encoding 区分
+func CacheKeyEncoding(req *http.Request, config Config) string {
+	if encoding := PreferredEncoding(req, config); encoding != "" {
+		return encoding
+	}
+	return "identity"
+}
+
+func addVary(header http.Header, config Config) {
+	varies := "Accept-Encoding"
+	// 编码由转发的头决定时 共享缓存同样需要区分
+	if config.TrustForwardedEncoding {
+		varies += ", " + http.CanonicalHeaderKey(config.ForwardedEncodingHeader)
+	}
+	// 按 User-Agent 跳过时 不同客户端的响应也不同
+	if len(config.SkipUserAgents) != 0 {
+		varies += ", User-Agent"
+	}
+	vary := header.Get("Vary")
+	if vary == "" {
+		vary = varies
+	} else {
+		vary += ", " + varies
+	}
+	header.Set("Vary", vary)
+}
+
+func getEncoding(req *http.Request, config Config) (encoding string) {
+	if encodings := getEncodings(req, config); len(encodings) != 0 {
+		encoding = encodings[0]
+	}
+	return
+}
+
+// 客户端接受且启用的编码 按 q 值排序, q 相同时按优先级 x-snappy-framed > br > zstd > gzip
+func getEncodings(req *http.Request, config Config) (encodings []string) {
+	encodings, _, _ = negotiate(req, config)
+	return
+}
+
+func setNegotiation(header http.Header, offered []string, chosen string) {
+	header.Set("X-Compress-Negotiation", "offered="+strings.Join(offered, ",")+"; chosen="+chosen)
+}
+
+// 解析 Accept-Encoding 中的一项 br;q=0.8 返回编码和 q 值
+// 忽略 q 以外的参数, 没有 q 或 q 不合法时为 1
+func parseCoding(val string) (coding string, q float64) {
+	q = 1
+	params := strings.Split(val, ";")
+	// content-coding 和参数名不区分大小写
+	coding = strings.ToLower(strings.TrimSpace(params[0]))
+	for _, param := range params[1:] {
+		i := strings.IndexByte(param, '=')
+		if i == -1 || !strings.EqualFold(strings.TrimSpace(param[:i]), "q") {
+			continue
+		}
+		if val, err := strconv.ParseFloat(strings.TrimSpace(param[i+1:]), 64); err == nil {
+			q = val
+		}
 	}
+	return
 }
 
-func getEncoding(req *http.Request) (encoding string) {
+// offered 为客户端接受的编码 按出现的顺序 同义词为标准名, disabled 表示客户端接受的编码被配置禁用
+func negotiate(req *http.Request, config Config) (encodings, offered []string, disabled bool) {
 	if req.Method == http.MethodOptions {
 		return
 	}
-	if req.Proto == "HTTP/1.0" {
+	if req.Proto == "HTTP/1.0" && !config.AllowHTTP10 {
 		return
 	}
-	if strings.Contains(req.Header.Get("Connection"), "Upgrade") {
+	// Connection 是逗号分隔的 token 列表
+	if hasToken(req.Header.Get("Connection"), "Upgrade") {
 		return
 	}
 
-	for _, val := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
-		val = strings.TrimSpace(val)
-		if val == "br" {
-			encoding = val
-			break
+	acceptEncoding := req.Header.Get("Accept-Encoding")
+	if config.TrustForwardedEncoding {
+		if val, ok := req.Header[http.CanonicalHeaderKey(config.ForwardedEncodingHeader)]; ok && len(val) != 0 {
+			acceptEncoding = val[0]
+		}
+	}
+
+	// 接受且启用的编码的 q 值, 0 表示不使用
+	var qSnappy, qBr, qZstd, qGzip float64
+	for _, val := range strings.Split(acceptEncoding, ",") {
+		val, q := parseCoding(val)
+		// q=0 表示不接受
+		if q <= 0 {
+			continue
+		}
+		// 同义词统一为标准名 Content-Encoding 始终返回标准名
+		if val == "x-gzip" {
+			val = "gzip"
+		} else if val == "x-br" && config.AcceptLegacyBrotliToken {
+			val = "br"
+		}
+		if val != "" && !contains(offered, val) {
+			offered = append(offered, val)
+		}
+		switch val {
+		case "x-snappy-framed":
+			qSnappy = enabled(config.EnableSnappy, q)
+			disabled = disabled || !config.EnableSnappy
+		case "br":
+			brotli := !config.DisableBrotli && (!config.BrotliRequireTLS || req.TLS != nil)
+			qBr = enabled(brotli, q)
+			disabled = disabled || !brotli
+		case "zstd":
+			qZstd = enabled(config.EnableZstd, q)
+			disabled = disabled || !config.EnableZstd
+		case "gzip":
+			qGzip = enabled(!config.DisableGzip, q)
+			disabled = disabled || config.DisableGzip
+		}
+	}
+	// q 值高的优先, 相同时按服务端的优先级 x-snappy-framed > br > zstd > gzip
+	var weights []float64
+	for _, candidate := range [...]struct {
+		encoding string
+		q        float64
+	}{{"x-snappy-framed", qSnappy}, {"br", qBr}, {"zstd", qZstd}, {"gzip", qGzip}} {
+		if candidate.q <= 0 {
+			continue
 		}
-		if val == "gzip" {
-			encoding = val
+		i := len(encodings)
+		for i > 0 && weights[i-1] < candidate.q {
+			i--
 		}
+		encodings = append(encodings, "")
+		weights = append(weights, 0)
+		copy(encodings[i+1:], encodings[i:])
+		copy(weights[i+1:], weights[i:])
+		encodings[i], weights[i] = candidate.encoding, candidate.q
 	}
 	return
 }
 
+func enabled(ok bool, q float64) float64 {
+	if !ok {
+		return 0
+	}
+	return q
+}
+
+func contains(values []string, val string) bool {
+	for _, v := range values {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// 逗号分隔的 token 列表中是否包含 token 忽略大小写和参数
+func hasToken(value, token string) bool {
+	for _, val := range strings.Split(value, ",") {
+		if i := strings.IndexAny(val, "=;"); i != -1 {
+			val = val[:i]
+		}
+		if strings.EqualFold(strings.TrimSpace(val), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func skipUserAgent(userAgent string, skipUserAgents []string) bool {
+	if userAgent == "" {
+		return false
+	}
+	for _, val := range skipUserAgents {
+		if val != "" && strings.Contains(userAgent, val) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMethod(method string, methods []string) bool {
+	for _, val := range methods {
+		if val == "*" || val == method {
+			return true
+		}
+	}
+	return false
+}
+
+func excludeExtension(urlPath string, extensions []string) bool {
+	if len(extensions) == 0 {
+		return false
+	}
+	extension := strings.ToLower(path.Ext(urlPath))
+	for _, val := range extensions {
+		if extension == val {
+			return true
+		}
+	}
+	return false
+}
+
 func (w *compressWriter) WriteString(data string) (int, error) {
-	return w.writer.Write([]byte(data))
+	return w.Write([]byte(data))
 }
 
-func (w *compressWriter) Write(data []byte) (int, error) {
-	if !w.Written() {
-		w.open(int64(len(data)))
+func (w *compressWriter) Write(data []byte) (n int, err error) {
+	if w.config.ConcurrentSafe {
+		w.mu.Lock()
+		defer w.mu.Unlock()
 	}
-	return w.writer.Write(data)
+	// 结束后没有压缩的响应直接写入底层 比如 gin 在中间件返回后写入的 404 内容
+	if w.closed {
+		if w.stats.Encoding == "" || w.config.DryRun {
+			return w.ResponseWriter.Write(data)
+		}
+		return 0, ErrWriteAfterClose
+	}
+	if !w.opened {
+		// 流式响应不缓存 按长度未知处理
+		// 长度未知且还不够 MinLength 先缓存
+		if w.buffer == nil && w.streaming() {
+			w.sniff = data
+			w.open(-1)
+		} else if w.buffer != nil || w.shouldBuffer(len(data)) {
+			if w.buffer == nil {
+				w.buffer = w.bufferPool.Get().(*[]byte)
+			}
+			size := int64(len(*w.buffer) + len(data))
+			if size <= w.config.MinLength && size <= w.config.MaxBufferBytes {
+				*w.buffer = append(*w.buffer, data...)
+				return len(data), nil
+			}
+			// 超过 MinLength 按总长度决定 这次的内容不复制进缓存
+			// 超过 MaxBufferBytes 还没到 MinLength 按长度未知处理
+			if size <= w.config.MinLength {
+				size = -1
+			}
+			if err = w.drain(size); err != nil {
+				return
+			}
+		} else {
+			w.sniff = data
+			w.open(int64(len(data)))
+		}
+	}
+	return w.write(data)
+}
+
+func (w *compressWriter) shouldBuffer(n int) bool {
+	return w.config.MinLength > 0 && int64(n) <= w.config.MinLength && w.Header().Get("Content-Length") == ""
+}
+
+// 没有声明长度 并且声明了 chunked 或者是 SSE NDJSON 等逐条发送的类型
+func (w *compressWriter) streaming() bool {
+	header := w.Header()
+	if header.Get("Content-Length") != "" {
+		return false
+	}
+	if hasToken(header.Get("Transfer-Encoding"), "chunked") {
+		return true
+	}
+	return streamType(header)
+}
+
+// Set-Cookie 中是否有 CSRF token 类的 cookie
+func csrfCookie(header http.Header) bool {
+	for _, val := range header["Set-Cookie"] {
+		name := val
+		if i := strings.IndexByte(name, '='); i != -1 {
+			name = name[:i]
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if strings.Contains(name, "csrf") || strings.Contains(name, "xsrf") {
+			return true
+		}
+	}
+	return false
+}
+
+func streamType(header http.Header) bool {
+	mediatype, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch mediatype {
+	case "text/event-stream", "application/x-ndjson":
+		return true
+	}
+	return false
+}
+
+const (
+	entropySample    = 4096
+	entropyMinSample = 256
+	entropyMaxRatio  = 0.9
+)
+
+// 前 entropySample 字节 s2 压缩后和原长度的比例
+// s2 只查找重复不做熵编码, 比 gzip 快得多 文本通常在 0.7 以下, 随机数据的 base64 接近 1
+func sampleRatio(data []byte) float64 {
+	if len(data) > entropySample {
+		data = data[:entropySample]
+	}
+	return float64(len(s2.Encode(nil, data))) / float64(len(data))
+}
+
+// 用 contentLength 决定是否压缩 写出缓存的内容后放回池
+func (w *compressWriter) drain(contentLength int64) (err error) {
+	buffer := w.buffer
+	w.buffer = nil
+	w.sniff = *buffer
+	w.open(contentLength)
+	_, err = w.write(*buffer)
+	*buffer = (*buffer)[:0]
+	w.bufferPool.Put(buffer)
+	return
+}
+
+func (w *compressWriter) write(data []byte) (n int, err error) {
+	if w.stats.Encoding == "" {
+		n, err = w.writer.Write(data)
+	} else if len(data) != 0 {
+		// 原内容直接发送 压缩器的输出丢弃只计数
+		if w.config.DryRun {
+			if n, err = w.ResponseWriter.Write(data); err != nil {
+				w.stats.OriginalBytes += int64(n)
+				return
+			}
+		}
+		// 空写入不经过压缩器 gzip 会因此提前输出头
+		start := time.Now()
+		n, err = w.writer.Write(data)
+		w.stats.DurationNanos += int64(time.Since(start))
+		if w.config.Timeout > 0 && !w.timeout && w.encoding == "gzip" {
+			w.crc = crc32.Update(w.crc, crc32.IEEETable, data[:n])
+		}
+	}
+	w.stats.OriginalBytes += int64(n)
+	if w.config.Timeout > 0 && !w.timeout && time.Duration(w.stats.DurationNanos) > w.config.Timeout {
+		w.fallback()
+	}
+	return
+}
+
+// 压缩超时 刷新 gzip 的 deflate 流到字节边界后放回池, 剩余内容作为同一个 deflate 流的 stored block 写入
+// 不能另起一个 gzip 成员: Chromium 等只解码第一个成员, 后面的内容会被丢弃
+func (w *compressWriter) fallback() {
+	if w.encoding != "gzip" || w.codec == nil || w.config.GzipWriterFactory != nil {
+		return
+	}
+	writer, ok := w.codec.(*gzip.Writer)
+	if !ok {
+		return
+	}
+	writer.Flush()
+	w.release()
+
+	w.timeout = true
+	stored, _ := flate.NewWriter(&w.counter, flate.NoCompression)
+	codec := &storedGzip{Writer: stored, dst: &w.counter, crc: w.crc, size: uint32(w.stats.OriginalBytes)}
+	w.writer, w.codec, w.release = codec, codec, nil
+}
+
+// 接着已经刷新的 gzip 成员写入不压缩的 deflate block, Close 时结束 deflate 流并写入 gzip 的 CRC-32 和长度
+type storedGzip struct {
+	*flate.Writer
+	dst  io.Writer
+	crc  uint32
+	size uint32
+}
+
+func (w *storedGzip) Write(data []byte) (int, error) {
+	n, err := w.Writer.Write(data)
+	w.crc = crc32.Update(w.crc, crc32.IEEETable, data[:n])
+	w.size += uint32(n)
+	return n, err
+}
+
+func (w *storedGzip) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		return err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], w.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], w.size)
+	_, err := w.dst.Write(trailer[:])
+	return err
+}
+
+// 先刷新压缩器缓冲再刷新底层 ctx.Stream 等流式输出每次都能解码
+// CloseNotify 直接使用底层的 不影响 ctx.Stream 的退出
+func (w *compressWriter) Flush() {
+	if w.config.ConcurrentSafe {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+	}
+	if w.closed {
+		if w.stats.Encoding == "" || w.config.DryRun {
+			w.ResponseWriter.Flush()
+		}
+		return
+	}
+	// 刷新会发送头 写入之前刷新长度未知, 有缓存时说明是流式响应 同样按长度未知处理
+	if w.buffer != nil {
+		w.drain(-1)
+	} else if !w.opened {
+		w.open(-1)
+	}
+	// 刷新后无法再转码
+	if w.transcode != nil {
+		w.passthrough()
+	}
+	start := time.Now()
+	w.flushCodec()
+	if w.stats.Encoding != "" {
+		w.stats.DurationNanos += int64(time.Since(start))
+	}
+	if w.hold != nil {
+		w.hold.spill()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// 只把压缩器缓冲的内容写入底层 不刷新底层 writer
+func (w *compressWriter) flushCodec() {
+	if writer, ok := w.writer.(interface{ Flush() error }); ok {
+		writer.Flush()
+	}
+}
+
+// 支持 http.ResponseController 设置读写超时, Flush 和 Hijack 仍然由 compressWriter 处理
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return unwrap(w.ResponseWriter)
+}
+
+// 处理函数写入的字节数 (压缩前)
+// 内嵌 writer 的 Size() 是实际发送的字节数 (压缩后), 压缩器内未刷新的数据不计入; gin.Logger 等访问日志读到的是压缩后的大小
+func (w *compressWriter) OriginalSize() int {
+	return int(w.stats.OriginalBytes)
 }
 
 func (w *compressWriter) WriteHeader(code int) {
+	// 1xx 不是最终响应 不记录状态码也不触发压缩
+	// gin 的 writer 只记录状态码无法单独发送 1xx, 直接发给底层的 http.ResponseWriter
+	if informational(code) {
+		if writer := unwrap(w.ResponseWriter); writer != nil && !w.ResponseWriter.Written() {
+			writer.WriteHeader(code)
+		}
+		return
+	}
+	// 头发送之前和 gin 的 writer 一致 后面的调用覆盖前面的状态码, ctx.Status ctx.String 等直接写入 gin 的 writer 同样如此
+	// 头已经发送后状态码无法修改 忽略并记录, Status() 仍然是实际发送的状态码
+	// gin 的 Redirect 等用 -1 表示不修改状态码 不算调用
+	if code <= 0 {
+		return
+	}
+	if w.ResponseWriter.Written() {
+		if code != w.Status() {
+			w.logf("gin-compress: superfluous WriteHeader call %d, status %d", code, w.Status())
+		}
+		return
+	}
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// 还没决定是否压缩时不发送头 推迟到第一次写入, 没有写入时由 gin (或 NewWriter 返回的函数) 发送
+// 声明的 Content-Length 不超过 MinLength 时不用等到写入 直接跳过并发送头
+func (w *compressWriter) WriteHeaderNow() {
+	if w.config.ConcurrentSafe {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+	}
+	if !w.opened && w.buffer == nil && !w.closed {
+		if val, err := strconv.ParseInt(strings.TrimSpace(w.Header().Get("Content-Length")), 10, 64); err == nil && val >= 0 && val <= w.config.MinLength {
+			w.open(val)
+		}
+	}
+	if w.opened {
+		w.ResponseWriter.WriteHeaderNow()
+	} else {
+		w.headerNow = true
+	}
+}
+
+// 推迟发送的头和 MinLength 缓存中的内容也算已经写入, 后面的中间件据此判断响应是否已经完成 (比如 AbortWithStatus 之后)
+func (w *compressWriter) Written() bool {
+	return w.headerNow || w.buffer != nil || w.opened || w.ResponseWriter.Written()
+}
+
+func informational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// 不压缩 还原为原始 writer 后续写入不再经过计数
+// 跳过时不修改处理函数设置的头 (只有 Debug 时添加 X-Compress-Skip), 头的修改放在决定压缩之后
+func (w *compressWriter) skip(reason SkipReason) {
+	w.stats.Skipped, w.stats.SkipReason = true, reason
+	if w.config.Debug {
+		w.Header().Set("X-Compress-Skip", string(reason))
+	}
+	w.writer = w.ResponseWriter
+}
+
 func (w *compressWriter) open(contentLength int64) {
+	w.opened = true
 	header := w.Header()
+	sniff := w.sniff
+	w.sniff = nil
 
-	// 长度过滤
-	if contentLength == -1 {
-		if val, ok := header["Content-Length"]; ok && len(val) != 0 {
-			if val, err := strconv.ParseInt(val[0], 10, 64); err != nil {
-				contentLength = val
-			}
+	// 头已经绕过 compressWriter 发送 无法再设置 Content-Encoding
+	if w.ResponseWriter.Written() {
+		w.skip(SkipHeaderWritten)
+		return
+	}
+
+	// 处理函数已经设置了编码 identity 表示不压缩, 本身就是默认值直接删除
+	// 其他编码包括不认识的 compress 和自定义编码 原样保留头和内容, 不解码也不二次压缩
+	// httputil.ReverseProxy 复制的上游 Content-Encoding 同样在这里跳过
+	// 上游 chunked 时 ReverseProxy 在写入之前刷新, 按长度未知处理 需要开启 CompressUnknownLength
+	// 开启 Transcode 时 gzip 的内容继续检查, 满足条件时暂存 结束时转为 brotli
+	var transcode bool
+	if val := header.Get("Content-Encoding"); val != "" {
+		if strings.EqualFold(strings.TrimSpace(val), "identity") {
+			header.Del("Content-Encoding")
+			w.skip(SkipIdentity)
+			return
 		}
+		if !w.transcodable(val) {
+			w.skip(SkipAlreadyEncoded)
+			return
+		}
+		transcode = true
+	}
+
+	// 不允许转换
+	if hasToken(header.Get("Cache-Control"), "no-transform") {
+		w.skip(SkipNoTransform)
+		return
+	}
+
+	if !w.config.CacheControlPolicy.allow(header.Get("Cache-Control")) {
+		w.skip(SkipCacheControl)
+		return
 	}
 
-	if w.config.MinLength >= contentLength {
+	if w.config.ShouldCompress != nil && !w.config.ShouldCompress(w.request, header) {
+		w.skip(SkipShouldCompress)
+		return
+	}
+	if w.config.BreachMitigation && csrfCookie(header) {
+		w.skip(SkipBreach)
+		return
+	}
+
+	// 状态码过滤 1xx 不是最终响应, 重定向等 3xx 内容很小不压缩
+	if status := w.Status(); status < 200 || (status >= 300 && status < 400) {
+		w.skip(SkipStatusNotCompressible)
+		return
+	}
+
+	// 部分内容 (ServeContent 处理 Range 请求等) 压缩后范围对应的字节没有意义
+	if w.Status() == http.StatusPartialContent || header.Get("Content-Range") != "" {
+		w.skip(SkipRange)
+		return
+	}
+
+	// 长度过滤 声明了 Content-Length 以声明的为准, 分次写入时第一次写入就按声明的长度决定 不会缓存
+	// 负数表示长度未知 比如 ctx.DataFromReader 传入 -1, 格式错误或溢出同样按长度未知处理
+	var declared bool
+	if val, ok := header["Content-Length"]; ok && len(val) != 0 {
+		if val, err := strconv.ParseInt(strings.TrimSpace(val[0]), 10, 64); err == nil {
+			contentLength, declared = val, true
+		} else {
+			contentLength = -1
+		}
+	}
+
+	if contentLength < 0 {
+		// 长度未知的流 开启后直接压缩
+		if !w.config.CompressUnknownLength && !streamType(header) {
+			w.skip(SkipUnknownLength)
+			return
+		}
+	} else if w.config.MinLength >= contentLength {
+		w.skip(SkipTooShort)
+		return
+	}
+	if transcode && contentLength > w.config.TranscodeMaxBytes {
+		w.skip(SkipAlreadyEncoded)
 		return
 	}
 
-	// 内容类型过滤
+	// 根据声明的长度选择编码
+	if w.config.AdaptiveCodec && w.encoding == "br" && declared && contentLength >= 0 && contentLength < w.config.AdaptiveThreshold {
+		for _, encoding := range w.encodings {
+			if encoding == "gzip" {
+				w.encoding = encoding
+				break
+			}
+		}
+		if transcode {
+			w.skip(SkipAlreadyEncoded)
+			return
+		}
+	}
+
+	// 内容类型过滤 第一次写入时读取
+	// http.ServeContent (ctx.File 等) 会在写入前按扩展名或内容嗅探设置好 Content-Type
+	// gin v1.3.0 的 ctx.Render 只在不允许内容的状态码时调用 WriteContentType, 内置的 render 在 Render 中写入之前设置
+	// 自定义的 render.Render 需要同样在第一次写入之前调用 WriteContentType, 否则没有类型不压缩
 	var contentType []string
 	var ok bool
 	if contentType, ok = header["Content-Type"]; !ok || len(contentType) == 0 {
+		w.skip(SkipMimeMismatch)
 		return
 	}
+	// 设置了多个值时只使用第一个 参数错误 (ErrInvalidMediaParameter) 时仍会返回类型
+	// 参数 (charset 等) 只在匹配时忽略, 除了 SniffOverrideOctetStream 不修改发送的 Content-Type
 	mediatype, _, _ := mime.ParseMediaType(contentType[0])
+	if mediatype == "" {
+		w.skip(SkipMimeMismatch)
+		return
+	}
+	var sniffed string
+	// 转码时 sniff 是压缩后的内容 不能用于嗅探和估算
+	if transcode {
+		sniff = nil
+	}
+	if mediatype == "application/octet-stream" && w.config.SniffOverrideOctetStream && len(sniff) != 0 {
+		sniffed = http.DetectContentType(sniff)
+		mediatype, _, _ = mime.ParseMediaType(sniffed)
+	}
 	var typeMatch bool
 	for _, typ := range w.config.Types {
-		if mediatype == typ {
+		if mediatype == typ || (typ == "*" || typ == "*/*") && !incompressible(mediatype) {
 			typeMatch = true
 			break
 		}
 	}
 	if !typeMatch {
+		w.skip(SkipMimeMismatch)
 		return
 	}
+	if sniffed != "" {
+		header.Set("Content-Type", sniffed)
+	}
 
-	header.Del("Content-Length")
-	header.Set("Content-Encoding", w.encoding)
+	// 按类型选择编码
+	if codec, ok := w.config.CodecByType[mediatype]; ok && codec != w.encoding && contains(w.encodings, codec) {
+		// 转码只用于 br
+		if transcode {
+			w.skip(SkipAlreadyEncoded)
+			return
+		}
+		w.encoding = codec
+	}
+
+	// 高熵内容压缩率很低
+	if w.config.EntropyCheck && len(sniff) >= entropyMinSample && sampleRatio(sniff) > entropyMaxRatio {
+		w.skip(SkipEntropy)
+		return
+	}
 
 	// head 方法 无内容
 	if w.request.Method == http.MethodHead {
+		if !w.config.DryRun {
+			w.setHeader()
+		}
+		w.skip(SkipHead)
+		return
+	}
+
+	if transcode {
+		w.transcode = &transcodeBuffer{w: w}
+		w.writer = w.transcode
 		return
 	}
 
+	if !w.start() {
+		w.skip(SkipCodecError)
+	}
+}
+
+// 创建压缩器并设置头 之后写入的内容都经过压缩器
+func (w *compressWriter) start() bool {
+	if !w.newCodec() {
+		return false
+	}
+	if w.config.DryRun {
+		w.counter.Writer = ioutil.Discard
+		w.stats.Encoding, w.stats.DryRun = w.encoding, true
+		if w.config.Debug {
+			w.Header().Set("X-Compress-Dry-Run", w.info)
+		}
+		return true
+	}
+	w.setHeader()
+	w.stats.Encoding = w.encoding
+	if w.config.Debug {
+		w.Header().Set("X-Compress-Info", w.info)
+	}
+	length := w.config.AlwaysContentLength || w.request.Proto == "HTTP/1.0"
+	etag := w.config.ETag && w.request.Method == http.MethodGet && w.Status() == http.StatusOK
+	if w.config.Debug || length || etag {
+		w.hold = &holdWriter{
+			Writer: w.counter.Writer,
+			header: w.Header(),
+			limit:  w.config.MaxBufferBytes,
+			debug:  w.config.Debug,
+			length: length,
+		}
+		if etag {
+			w.hold.etag = w.encoding
+			w.hold.ifNoneMatch = w.request.Header.Get("If-None-Match")
+		}
+		w.counter.Writer = w.hold
+	}
+	return true
+}
+
+// 压缩后长度未知 必须删除 Content-Length
+// HTTP/1.1 下走 chunked, HTTP/2 下由帧结束, 声明的 Trailer 都能在 close() 之后正常发送
+func (w *compressWriter) setHeader() {
+	header := w.Header()
+	w.contentLength = header.Get("Content-Length")
+	header.Del("Content-Length")
+	// 压缩后的内容不支持按字节范围请求
+	w.acceptRanges = header.Get("Accept-Ranges")
+	header.Del("Accept-Ranges")
+	// Transfer-Encoding: identity 会让 net/http 不使用 chunked 而以关闭连接结束, chunked 由 net/http 自己设置
+	w.transferEncoding = header.Get("Transfer-Encoding")
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Encoding", w.encoding)
+	if w.config.VaryOnlyWhenCompressed {
+		w.vary, w.varySet = header["Vary"]
+		addVary(header, w.config)
+	}
+	if w.config.Debug {
+		setNegotiation(header, w.offered, w.encoding)
+	}
+}
+
+// 设置编码后回退到不压缩 只能在头发送之前调用
+// 去掉 Content-Encoding 恢复 setHeader 去掉的头, 压缩器之后的输出全部丢弃
+func (w *compressWriter) identity(reason SkipReason) {
+	header := w.Header()
+	header.Del("Content-Encoding")
+	if w.contentLength != "" {
+		header.Set("Content-Length", w.contentLength)
+	}
+	if w.acceptRanges != "" {
+		header.Set("Accept-Ranges", w.acceptRanges)
+	}
+	if w.transferEncoding != "" {
+		header.Set("Transfer-Encoding", w.transferEncoding)
+	}
+	header.Del("X-Compress-Info")
+	if w.config.VaryOnlyWhenCompressed {
+		if w.varySet {
+			header["Vary"] = w.vary
+		} else {
+			header.Del("Vary")
+		}
+	}
+	w.counter.Writer = ioutil.Discard
+	w.hold = nil
+	w.stats.Encoding = ""
+	w.stats.Skipped, w.stats.SkipReason = true, reason
+	if w.config.Debug {
+		header.Set("X-Compress-Skip", string(reason))
+		setNegotiation(header, w.offered, "identity")
+	}
+}
+
+// 创建压缩器 brotli 创建失败时回退到 gzip (客户端接受时)
+func (w *compressWriter) newCodec() bool {
+	if w.encoding == "br" {
+		quality := w.config.BrQuality
+		if max := w.config.BrotliMaxQualityForDynamic; max > 0 && quality > max && w.dynamic() {
+			quality = max
+		}
+		active := atomic.AddInt64(w.brotli, 1)
+		lgwin := w.config.BrLGWin
+		if w.config.BrLGWinDynamic {
+			lgwin = dynamicLGWin(lgwin, active)
+		}
+		var writer io.WriteCloser
+		var err error
+		if w.config.BrotliWriterFactory != nil {
+			if writer = w.config.BrotliWriterFactory(&w.counter, quality, lgwin); writer == nil {
+				err = errors.New("brotli writer factory returned nil")
+			}
+		} else {
+			writer, err = newBrotliWriter(&w.counter, cbrotli.WriterOptions{
+				Quality: quality,
+				LGWin:   lgwin,
+			})
+		}
+		if err == nil {
+			// brotli 不使用池 只更新正在进行的数量
+			w.writer, w.codec = writer, writer
+			w.release = func() { atomic.AddInt64(w.brotli, -1) }
+			w.info = "br;q=" + strconv.Itoa(quality) + ";lgwin=" + strconv.Itoa(lgwin)
+			return true
+		}
+		atomic.AddInt64(w.brotli, -1)
+		w.logf("gin-compress: create brotli writer: %v", err)
+		w.encoding = ""
+		for _, encoding := range w.encodings {
+			if encoding == "gzip" {
+				w.encoding = encoding
+				break
+			}
+		}
+	}
+
 	switch w.encoding {
-	case "br":
-		writer := cbrotli.NewWriter(w.ResponseWriter, cbrotli.WriterOptions{
-			Quality: w.config.BrQuality,
-			LGWin:   w.config.BrLGWin,
-		})
-		w.writer = writer
 	case "gzip":
-		writer := w.gzipPool.Get().(*gzip.Writer)
-		writer.Reset(w.ResponseWriter)
-		w.writer = writer
+		w.info = "gzip;level=" + strconv.Itoa(w.config.GzipLevel)
+		if w.config.GzipWriterFactory != nil {
+			writer, err := w.config.GzipWriterFactory(&w.counter, w.config.GzipLevel)
+			if err == nil && writer == nil {
+				err = errors.New("gzip writer factory returned nil")
+			}
+			if err != nil {
+				w.logf("gin-compress: create gzip writer: %v", err)
+				return false
+			}
+			w.writer, w.codec = writer, writer
+			break
+		}
+		pool := w.gzipPool
+		writer := pool.Get().(*gzip.Writer)
+		writer.Reset(&w.counter)
+		w.writer, w.codec = writer, writer
+		w.release = func() { pool.Put(writer) }
+	case "zstd":
+		pool := w.zstdPool
+		writer := pool.Get().(*zstd.Encoder)
+		writer.Reset(&w.counter)
+		w.writer, w.codec = writer, writer
+		w.release = func() { pool.Put(writer) }
+		w.info = "zstd;level=" + strconv.Itoa(w.config.ZstdLevel)
+		if len(w.config.ZstdDict) != 0 {
+			w.info += ";dict"
+		}
+	case "x-snappy-framed":
+		pool := w.snappyPool
+		writer := pool.Get().(*s2.Writer)
+		writer.Reset(&w.counter)
+		w.writer, w.codec = writer, writer
+		w.release = func() { pool.Put(writer) }
+		w.info = "x-snappy-framed"
+	default:
+		return false
 	}
+	return true
 }
 
-func (w *compressWriter) close() {
-	switch w.writer.(type) {
-	case *gzip.Writer:
-		writer := w.writer.(*gzip.Writer)
-		writer.Close()
-		w.gzipPool.Put(writer)
-	case *cbrotli.Writer:
-		writer := w.writer.(*cbrotli.Writer)
+const (
+	brLGWinDefault     = 22
+	brLGWinMin         = 18
+	brLGWinConcurrency = 16
+)
+
+// active 为包括当前请求在内正在进行的 brotli 压缩数量
+func dynamicLGWin(lgwin int, active int64) int {
+	if lgwin == 0 {
+		lgwin = brLGWinDefault
+	}
+	for ; active > brLGWinConcurrency && lgwin > brLGWinMin; active /= 2 {
+		lgwin--
+	}
+	return lgwin
+}
+
+func (w *compressWriter) dynamic() bool {
+	if w.config.Dynamic != nil {
+		return w.config.Dynamic(w.request, w.Header())
+	}
+	return dynamicResponse(w.Header())
+}
+
+func dynamicResponse(header http.Header) bool {
+	cacheControl := header.Get("Cache-Control")
+	if cacheControl == "" {
+		return true
+	}
+	for _, val := range strings.Split(cacheControl, ",") {
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "no-store", "no-cache", "private", "max-age=0":
+			return true
+		}
+	}
+	return false
+}
+
+func (w *compressWriter) logf(format string, args ...interface{}) {
+	if w.config.Logger != nil {
+		w.config.Logger(format, args...)
+	}
+}
+
+// 创建失败时 cbrotli 不会返回错误, 空写入检查内部状态
+var newBrotliWriter = func(dst io.Writer, options cbrotli.WriterOptions) (io.WriteCloser, error) {
+	writer := cbrotli.NewWriter(dst, options)
+	if _, err := writer.Write(nil); err != nil {
+		// 释放 C 的编码器状态
 		writer.Close()
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (w *compressWriter) close() {
+	if w.config.ConcurrentSafe {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+	}
+	if w.buffer != nil {
+		w.drain(int64(len(*w.buffer)))
+	}
+	if w.transcode != nil {
+		w.finishTranscode()
+	}
+
+	// 开始压缩后没有写入任何内容且头还没发送 去掉 Content-Encoding 丢弃压缩器的输出
+	// HEAD 请求不经过压缩器 保留和 GET 一致的头
+	if w.stats.Encoding != "" && w.stats.OriginalBytes == 0 && !w.ResponseWriter.Written() {
+		w.identity(SkipEmpty)
+	}
+
+	// 先完整刷新缓冲再关闭 再放回池, 每种编码的 release 在 newCodec 中设置
+	start := time.Now()
+	w.flushCodec()
+	if w.codec != nil {
+		w.codec.Close()
+		if w.release != nil {
+			w.release()
+		}
+		w.codec, w.release = nil, nil
+	}
+	if w.stats.Encoding != "" {
+		w.stats.DurationNanos += int64(time.Since(start))
+	}
+	// ETag 匹配时不发送内容 头还没有发送 可以修改状态码
+	var notModified bool
+	if w.hold != nil && w.hold.finish(w.stats.OriginalBytes, w.counter.n) {
+		notModified = true
+		w.ResponseWriter.WriteHeader(http.StatusNotModified)
+		w.ResponseWriter.WriteHeaderNow()
+	}
+	// 压缩器可能已经放回池被其他请求使用 压缩过的响应之后的写入直接返回错误
+	w.writer = nil
+	w.closed = true
+
+	if w.cache != nil && !notModified && !w.stats.Skipped && w.stats.Encoding != "" && !w.cache.over {
+		if ttl := cacheTTL(w.Status(), w.Header(), w.config); ttl > 0 {
+			w.config.Cache.Set(w.cacheKey, CacheEntry{
+				Status:        w.Status(),
+				Header:        w.Header().Clone(),
+				Body:          append([]byte(nil), w.cache.Bytes()...),
+				OriginalBytes: w.stats.OriginalBytes,
+				Expires:       time.Now().Add(ttl),
+			})
+		}
+	}
+
+	if w.config.OnComplete == nil {
+		return
+	}
+	if !w.stats.Skipped && !w.ResponseWriter.Written() {
+		w.stats.Skipped, w.stats.SkipReason = true, SkipEmpty
+	}
+	if w.stats.Skipped {
+		w.stats.CompressedBytes = w.stats.OriginalBytes
+	} else {
+		w.stats.CompressedBytes = w.counter.n
 	}
+	w.config.OnComplete(w.stats)
 }
@@ -0,0 +1,2664 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/brotli/go/cbrotli"
+	"github.com/klauspost/compress/dict"
+	kgzip "github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/otamoe/gin-compress/compresstest"
+)
+
+var testBody = strings.Repeat("hello world ", 200)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func testConfig() Config {
+	return Config{
+		Types:     []string{"text/plain", "text/html", "application/json"},
+		MinLength: 10,
+		BrQuality: 5,
+		BrLGWin:   22,
+		GzipLevel: 6,
+	}
+}
+
+func testEngine(config Config, handler gin.HandlerFunc) *gin.Engine {
+	engine := gin.New()
+	engine.Use(Compress(config))
+	engine.Any("/*path", handler)
+	return engine
+}
+
+func testRequest(method, target, acceptEncoding string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	return req
+}
+
+func stringHandler(body string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, body)
+	}
+}
+
+func TestBrotliWriterFailureFallsBackToGzip(t *testing.T) {
+	newWriter := newBrotliWriter
+	defer func() {
+		newBrotliWriter = newWriter
+	}()
+	newBrotliWriter = func(dst io.Writer, options cbrotli.WriterOptions) (io.WriteCloser, error) {
+		return nil, errors.New("brotli: out of memory")
+	}
+
+	var logged string
+	config := testConfig()
+	config.Logger = func(format string, args ...interface{}) {
+		logged = format
+	}
+	engine := testEngine(config, stringHandler(testBody))
+
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "br, gzip"), []byte(testBody))
+	if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", val)
+	}
+	if logged == "" {
+		t.Fatal("brotli failure not logged")
+	}
+
+	recorder = compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "br"), []byte(testBody))
+	if val := recorder.Header().Get("Content-Encoding"); val != "" {
+		t.Fatalf("Content-Encoding = %q, want none", val)
+	}
+}
+
+func TestNoRouteAfterClose(t *testing.T) {
+	engine := gin.New()
+	engine.Use(Compress(testConfig()))
+	engine.GET("/", stringHandler(testBody))
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, testRequest("GET", "/missing", "gzip"))
+	if recorder.Code != http.StatusNotFound || recorder.Body.String() != "404 page not found" {
+		t.Fatalf("got %d %q, want 404 page not found", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestOuterWriteAfterClose(t *testing.T) {
+	var err error
+	engine := gin.New()
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Next()
+		if !ctx.Writer.Written() {
+			_, err = ctx.Writer.WriteString("fallback")
+		}
+	})
+	engine.Use(Compress(testConfig()))
+	engine.GET("/", func(ctx *gin.Context) {})
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, testRequest("GET", "/", "gzip"))
+	if err != nil || recorder.Body.String() != "fallback" {
+		t.Fatalf("got %q %v, want fallback", recorder.Body.String(), err)
+	}
+}
+
+func TestWriteAfterCloseCompressed(t *testing.T) {
+	writer, finish := NewWriter(httptest.NewRecorder(), testRequest("GET", "/", "gzip"), testConfig())
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.Write([]byte(testBody))
+	finish()
+	if _, err := writer.Write([]byte("late")); err != ErrWriteAfterClose {
+		t.Fatalf("err = %v, want ErrWriteAfterClose", err)
+	}
+}
+
+func TestVaryForwardedEncoding(t *testing.T) {
+	config := testConfig()
+	config.TrustForwardedEncoding = true
+	engine := testEngine(config, stringHandler(testBody))
+
+	req := testRequest("GET", "/", "")
+	req.Header.Set("X-Original-Accept-Encoding", "gzip")
+	recorder := compresstest.AssertRoundTrip(t, engine, req, []byte(testBody))
+	if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", val)
+	}
+	if val := recorder.Header().Get("Vary"); val != "Accept-Encoding, X-Original-Accept-Encoding" {
+		t.Fatalf("Vary = %q", val)
+	}
+}
+
+func TestVarySkipUserAgents(t *testing.T) {
+	config := testConfig()
+	config.SkipUserAgents = []string{"MSIE 6"}
+	engine := testEngine(config, stringHandler(testBody))
+
+	for userAgent, encoding := range map[string]string{
+		"Mozilla/4.0 (compatible; MSIE 6.0)": "",
+		"Mozilla/5.0":                        "gzip",
+	} {
+		req := testRequest("GET", "/", "gzip")
+		req.Header.Set("User-Agent", userAgent)
+		recorder := compresstest.AssertRoundTrip(t, engine, req, []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != encoding {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", userAgent, val, encoding)
+		}
+		if val := recorder.Header().Get("Vary"); val != "Accept-Encoding, User-Agent" {
+			t.Fatalf("%s: Vary = %q", userAgent, val)
+		}
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	engine := testEngine(testConfig(), func(ctx *gin.Context) {
+		ctx.Header("Link", "</style.css>; rel=preload; as=style")
+		ctx.Writer.WriteHeader(http.StatusEarlyHints)
+		ctx.String(http.StatusOK, testBody)
+	})
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	var hints []int
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			hints = append(hints, code)
+			return nil
+		},
+	}))
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if len(hints) != 1 || hints[0] != http.StatusEarlyHints {
+		t.Fatalf("1xx = %v, want [103]", hints)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got %d %q", resp.StatusCode, resp.Header.Get("Content-Encoding"))
+	}
+	if val, err := compresstest.Decode("gzip", body); err != nil || string(val) != testBody {
+		t.Fatalf("decode: %v", err)
+	}
+}
+
+func recoveryJSON(ctx *gin.Context) {
+	defer func() {
+		if recover() != nil {
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": testBody})
+		}
+	}()
+	ctx.Next()
+}
+
+func TestPanicRecovery(t *testing.T) {
+	for name, test := range map[string]struct {
+		handlers []gin.HandlerFunc
+		encoding string
+	}{
+		"inner": {[]gin.HandlerFunc{Compress(testConfig()), recoveryJSON}, "gzip"},
+		"outer": {[]gin.HandlerFunc{recoveryJSON, Compress(testConfig())}, ""},
+	} {
+		engine := gin.New()
+		engine.Use(test.handlers...)
+		engine.GET("/", func(ctx *gin.Context) {
+			panic("boom")
+		})
+
+		want := []byte(`{"error":"` + testBody + `"}`)
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), want)
+		if recorder.Code != http.StatusInternalServerError {
+			t.Fatalf("%s: status = %d, want 500", name, recorder.Code)
+		}
+		if val := recorder.Header().Get("Content-Encoding"); val != test.encoding {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", name, val, test.encoding)
+		}
+	}
+}
+
+// 跳过压缩时 除了 wrap 添加的 Vary 之外 头和处理函数设置的完全一致
+func TestSkipKeepsHeaders(t *testing.T) {
+	png := strings.Repeat("\x89PNG", 100)
+	for name, test := range map[string]struct {
+		config func(*Config)
+		header http.Header
+		body   string
+	}{
+		"too short": {
+			header: http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"2"}, "X-Custom": {"a", "b"}},
+			body:   "hi",
+		},
+		"mime mismatch": {
+			header: http.Header{"Content-Type": {"image/png"}, "Content-Length": {strconv.Itoa(len(png))}, "Etag": {`"png"`}},
+			body:   png,
+		},
+		"no transform": {
+			header: http.Header{"Content-Type": {"text/plain"}, "Content-Length": {strconv.Itoa(len(testBody))}, "Cache-Control": {"public, no-transform"}},
+			body:   testBody,
+		},
+		"disabled": {
+			config: func(config *Config) {
+				config.DisableGzip = true
+			},
+			header: http.Header{"Content-Type": {"text/plain"}, "Content-Length": {strconv.Itoa(len(testBody))}},
+			body:   testBody,
+		},
+	} {
+		config := testConfig()
+		if test.config != nil {
+			test.config(&config)
+		}
+		engine := testEngine(config, func(ctx *gin.Context) {
+			for key, val := range test.header {
+				ctx.Writer.Header()[key] = append([]string(nil), val...)
+			}
+			ctx.Writer.WriteString(test.body)
+		})
+
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(test.body))
+		want := http.Header{"Vary": {"Accept-Encoding"}}
+		for key, val := range test.header {
+			want[key] = val
+		}
+		if !reflect.DeepEqual(recorder.Header(), want) {
+			t.Fatalf("%s: header = %v, want %v", name, recorder.Header(), want)
+		}
+	}
+}
+
+// 同一个 handler 挂到多个 engine 上并发使用 需要 go test -race 检查
+func TestHandlerSharedAcrossEngines(t *testing.T) {
+	config := testConfig()
+	config.MinLength = 100
+	config.EnableZstd = true
+	config.Cache = NewLRUCache(4)
+	config.PerRequest = func(ctx *gin.Context) *Config {
+		if ctx.Query("best") == "" {
+			return nil
+		}
+		override := PresetBest()
+		override.EnableZstd = true
+		return &override
+	}
+	handler := Compress(config)
+
+	engines := make([]*gin.Engine, 3)
+	for i := range engines {
+		engines[i] = gin.New()
+		engines[i].Use(handler)
+		engines[i].GET("/chunks", func(ctx *gin.Context) {
+			ctx.Header("Content-Type", "text/plain")
+			for i := 0; i < 20; i++ {
+				ctx.Writer.WriteString("hello ")
+			}
+		})
+		engines[i].GET("/", stringHandler(testBody))
+	}
+
+	var wait sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			engine := engines[i%len(engines)]
+			for j, encoding := range []string{"gzip", "br", "zstd", ""} {
+				target := "/"
+				if (i+j)%2 == 0 {
+					target += "?best=1"
+				}
+				compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, encoding), []byte(testBody))
+				compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/chunks", encoding), []byte(strings.Repeat("hello ", 20)))
+			}
+		}(i)
+	}
+	wait.Wait()
+}
+
+func TestHTTP2Trailer(t *testing.T) {
+	engine := testEngine(testConfig(), func(ctx *gin.Context) {
+		ctx.Header("Trailer", "X-Checksum")
+		ctx.Header("Content-Length", strconv.Itoa(len(testBody)))
+		ctx.String(http.StatusOK, testBody)
+		// 刷新后头已经发送 之后设置的值只能作为 trailer 发送
+		ctx.Writer.Flush()
+		ctx.Writer.Header().Set("X-Checksum", "abc")
+	})
+	server := httptest.NewUnstartedServer(engine)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Accept-Encoding", "br")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("proto = %s, want HTTP/2", resp.Proto)
+	}
+	if resp.Header.Get("Content-Encoding") != "br" || resp.Header.Get("Content-Length") != "" {
+		t.Fatalf("header = %v", resp.Header)
+	}
+	if val, err := compresstest.Decode("br", body); err != nil || string(val) != testBody {
+		t.Fatalf("decode: %v", err)
+	}
+	if val := resp.Trailer.Get("X-Checksum"); val != "abc" {
+		t.Fatalf("trailer = %q, want abc", val)
+	}
+}
+
+func TestMultipartSkippedByDefault(t *testing.T) {
+	for types, encoding := range map[string]string{
+		"":                    "",
+		"multipart/form-data": "gzip",
+	} {
+		config := testConfig()
+		config.Types = append([]string(nil), DefaultTypes...)
+		config.Types = append(config.Types, strings.Fields(types)...)
+		engine := testEngine(config, func(ctx *gin.Context) {
+			ctx.Data(http.StatusOK, "multipart/form-data; boundary=xyz", []byte(testBody))
+		})
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != encoding {
+			t.Fatalf("Types %q: Content-Encoding = %q, want %q", types, val, encoding)
+		}
+	}
+}
+
+// gin v1.3.0 没有 ctx.ProtoBuf, 序列化后的内容通过 ctx.Data 发送
+func TestProtobufOptIn(t *testing.T) {
+	message := bytes.Repeat([]byte{0x0a, 0x05, 'h', 'e', 'l', 'l', 'o', 0x10, 0x2a}, 50)
+	for _, optIn := range []bool{false, true} {
+		config := PresetBalanced()
+		config.MinLength = 0
+		if optIn {
+			config.Types = append(config.Types, "application/x-protobuf")
+		}
+		engine := testEngine(config, func(ctx *gin.Context) {
+			ctx.Data(http.StatusOK, "application/x-protobuf", message)
+		})
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), message)
+		if val := recorder.Header().Get("Content-Encoding"); (val == "gzip") != optIn {
+			t.Fatalf("opt in %v: Content-Encoding = %q", optIn, val)
+		}
+	}
+}
+
+func TestServeContentType(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "style.css"), []byte(testBody), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := PresetBalanced()
+	config.MinLength = 10
+	engine := gin.New()
+	engine.Use(Compress(config))
+	engine.GET("/content", func(ctx *gin.Context) {
+		http.ServeContent(ctx.Writer, ctx.Request, "index.html", time.Time{}, strings.NewReader(testBody))
+	})
+	engine.GET("/file", func(ctx *gin.Context) {
+		ctx.File(filepath.Join(dir, "style.css"))
+	})
+
+	for _, target := range []string{"/content", "/file"} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+			t.Fatalf("%s: Content-Encoding = %q, want gzip (Content-Type %q)", target, val, recorder.Header().Get("Content-Type"))
+		}
+	}
+}
+
+// JS 的媒体类型两种写法都在 DefaultTypes 中
+func TestJavaScriptTypes(t *testing.T) {
+	dir := t.TempDir()
+	script := strings.Repeat("console.log('hello world');\n", 100)
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.js"), []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := PresetBalanced()
+	engine := gin.New()
+	engine.Use(Compress(config))
+	engine.GET("/file", func(ctx *gin.Context) {
+		ctx.File(filepath.Join(dir, "app.js"))
+	})
+	engine.GET("/data", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, ctx.Query("type"), []byte(script))
+	})
+
+	targets := []string{"/file"}
+	for _, typ := range []string{"application/javascript", "text/javascript", "text/javascript; charset=utf-8"} {
+		targets = append(targets, "/data?type="+url.QueryEscape(typ))
+	}
+	for _, target := range targets {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, "br"), []byte(script))
+		if val := recorder.Header().Get("Content-Encoding"); val != "br" {
+			t.Fatalf("%s: Content-Encoding = %q, want br (Content-Type %q)", target, val, recorder.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	engine := testEngine(testConfig(), func(ctx *gin.Context) {
+		http.ServeContent(ctx.Writer, ctx.Request, "a.txt", time.Time{}, strings.NewReader(testBody))
+	})
+	// 完整响应压缩 去掉 Accept-Ranges
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	if recorder.Header().Get("Content-Encoding") != "gzip" || recorder.Header().Get("Accept-Ranges") != "" {
+		t.Fatalf("header = %v", recorder.Header())
+	}
+
+	// 范围请求不压缩
+	req := testRequest("GET", "/", "gzip")
+	req.Header.Set("Range", "bytes=10-99")
+	recorder = compresstest.AssertRoundTrip(t, engine, req, []byte(testBody[10:100]))
+	if recorder.Code != http.StatusPartialContent || recorder.Header().Get("Content-Encoding") != "" || recorder.Header().Get("Content-Range") == "" {
+		t.Fatalf("got %d %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestDeclaredLengthFirstWrite(t *testing.T) {
+	config := testConfig()
+	config.MinLength = 1000
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/plain")
+		ctx.Header("Content-Length", strconv.Itoa(len(testBody)))
+		ctx.Writer.WriteString(testBody[:5])
+		ctx.Writer.WriteString(testBody[5:])
+	})
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "br"), []byte(testBody))
+	if val := recorder.Header().Get("Content-Encoding"); val != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", val)
+	}
+	if val := recorder.Header().Get("Content-Length"); val != "" {
+		t.Fatalf("Content-Length = %q, want none", val)
+	}
+}
+
+func TestDeclaredTinyLength(t *testing.T) {
+	var stats CompressStats
+	body := testBody[:100]
+	config := testConfig()
+	config.MinLength = 1024
+	config.OnComplete = func(val CompressStats) {
+		stats = val
+	}
+	var headerNow, firstWrite bool
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/plain")
+		ctx.Header("Content-Length", "100")
+		if ctx.Query("now") != "" {
+			// 不用等到写入 头直接发送
+			ctx.Writer.WriteHeaderNow()
+			headerNow = ctx.Writer.Written()
+		}
+		// 第一次写入就跳过 不缓存
+		ctx.Writer.WriteString(body[:5])
+		firstWrite = ctx.Writer.Written()
+		ctx.Writer.WriteString(body[5:])
+	})
+	for _, target := range []string{"/", "/?now=1"} {
+		headerNow, firstWrite = false, false
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, "br"), []byte(body))
+		if recorder.Header().Get("Content-Encoding") != "" || recorder.Header().Get("Content-Length") != "100" {
+			t.Fatalf("%s: header = %v", target, recorder.Header())
+		}
+		if !firstWrite || headerNow != (target != "/") || stats.SkipReason != SkipTooShort {
+			t.Fatalf("%s: header now %v first write %v stats %+v", target, headerNow, firstWrite, stats)
+		}
+	}
+}
+
+// gin.Logger 记录 Status(), 访问日志读到的 Size() 是实际发送的压缩后字节数
+func TestAccessLog(t *testing.T) {
+	var log bytes.Buffer
+	var status, size int
+	engine := gin.New()
+	engine.Use(gin.LoggerWithWriter(&log))
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Next()
+		status, size = ctx.Writer.Status(), ctx.Writer.Size()
+	})
+	engine.Use(Compress(testConfig()))
+	engine.GET("/", func(ctx *gin.Context) {
+		ctx.String(http.StatusCreated, testBody)
+	})
+
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	if !strings.Contains(log.String(), " 201 ") {
+		t.Fatalf("log = %q, want status 201", log.String())
+	}
+	if status != http.StatusCreated || size != recorder.Body.Len() || size >= len(testBody) {
+		t.Fatalf("status %d size %d, want 201 and %d wire bytes", status, size, recorder.Body.Len())
+	}
+}
+
+// 上游 chunked 的响应 ReverseProxy 会在写入之前刷新, 按长度未知处理
+func TestReverseProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch req.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			writer := gzip.NewWriter(w)
+			writer.Write([]byte(testBody))
+			writer.Close()
+		case "/chunked":
+			w.Write([]byte(testBody))
+			w.(http.Flusher).Flush()
+		default:
+			w.Header().Set("Content-Length", strconv.Itoa(len(testBody)))
+			w.Write([]byte(testBody))
+		}
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	config := testConfig()
+	config.CompressUnknownLength = true
+	engine := testEngine(config, func(ctx *gin.Context) {
+		proxy.ServeHTTP(ctx.Writer, ctx.Request)
+	})
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	for _, path := range []string{"/identity", "/chunked", "/gzip"} {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if val := resp.Header.Get("Content-Encoding"); val != "gzip" {
+			t.Fatalf("%s: Content-Encoding = %q, want gzip", path, val)
+		}
+		// 上游已经压缩的内容不会二次压缩 只需要解码一次
+		if val, err := compresstest.Decode("gzip", body); err != nil || string(val) != testBody {
+			t.Fatalf("%s: decode: %v", path, err)
+		}
+	}
+}
+
+// 通过真实连接请求 返回按 Content-Encoding 解码的 reader
+func serveStream(t *testing.T, handler http.Handler, target, acceptEncoding string) (*http.Response, io.Reader) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	req, _ := http.NewRequest("GET", server.URL+target, nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	switch res.Header.Get("Content-Encoding") {
+	case "gzip":
+		reader, err := gzip.NewReader(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, reader
+	case "br":
+		return res, cbrotli.NewReader(res.Body)
+	}
+	return res, res.Body
+}
+
+func TestMixedCaseTypes(t *testing.T) {
+	config := testConfig()
+	config.Types = []string{"Text/HTML"}
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "TEXT/Html; charset=utf-8", []byte(testBody))
+	})
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", val)
+	}
+}
+
+func TestContentTypePaths(t *testing.T) {
+	config := testConfig()
+	config.Types = []string{"text/css"}
+	for name, handler := range map[string]gin.HandlerFunc{
+		"ctx.Header": func(ctx *gin.Context) {
+			ctx.Header("Content-Type", "text/css")
+			ctx.Writer.WriteString(testBody)
+		},
+		"Writer.Header": func(ctx *gin.Context) {
+			ctx.Writer.Header().Set("Content-Type", "text/css; charset=utf-8")
+			ctx.Writer.Write([]byte(testBody))
+		},
+		"ctx.Data": func(ctx *gin.Context) {
+			ctx.Data(http.StatusOK, "text/css", []byte(testBody))
+		},
+		// WriteHeader 只记录状态码 之后设置的类型同样生效
+		"after WriteHeader": func(ctx *gin.Context) {
+			ctx.Status(http.StatusAccepted)
+			ctx.Header("Content-Type", "text/css")
+			ctx.Writer.WriteString(testBody)
+		},
+		"after WriteHeaderNow": func(ctx *gin.Context) {
+			ctx.Writer.WriteHeaderNow()
+			ctx.Writer.Header().Set("Content-Type", "text/css")
+			ctx.Writer.WriteString(testBody)
+		},
+	} {
+		engine := testEngine(config, handler)
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+			t.Fatalf("%s: Content-Encoding = %q, want gzip", name, val)
+		}
+	}
+}
+
+func TestWildcardTypes(t *testing.T) {
+	for _, wildcard := range []string{"*", "*/*"} {
+		config := testConfig()
+		config.Types = []string{wildcard}
+		for typ, want := range map[string]string{
+			"text/plain":               "gzip",
+			"application/x-protobuf":   "gzip",
+			"image/svg+xml":            "gzip",
+			"application/vnd.api+json": "gzip",
+			"image/png":                "",
+			"video/mp4":                "",
+			"font/woff2":               "",
+			"application/zip":          "",
+			"application/octet-stream": "",
+		} {
+			engine := testEngine(config, func(ctx *gin.Context) {
+				ctx.Data(http.StatusOK, typ, []byte(testBody))
+			})
+			recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+			if val := recorder.Header().Get("Content-Encoding"); val != want {
+				t.Fatalf("%s %s: Content-Encoding = %q, want %q", wildcard, typ, val, want)
+			}
+		}
+	}
+}
+
+// 参数只在匹配时忽略 发送的 Content-Type 保持原样
+func TestContentTypeKeepsParams(t *testing.T) {
+	for _, typ := range []string{
+		"text/html; charset=utf-8",
+		"text/plain; charset=ISO-8859-1",
+		"Text/HTML;charset=UTF-8",
+		"application/json; charset=utf-8; profile=\"x\"",
+	} {
+		engine := testEngine(testConfig(), func(ctx *gin.Context) {
+			ctx.Data(http.StatusOK, typ, []byte(testBody))
+		})
+		for _, encoding := range []string{"gzip", "br"} {
+			recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", encoding), []byte(testBody))
+			if recorder.Header().Get("Content-Encoding") != encoding || recorder.Header().Get("Content-Type") != typ {
+				t.Fatalf("%s %s: header = %v", typ, encoding, recorder.Header())
+			}
+		}
+	}
+}
+
+func TestEmptyTypesUseDefault(t *testing.T) {
+	engine := testEngine(Config{MinLength: 10}, func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "text/css", []byte(testBody))
+	})
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", val)
+	}
+}
+
+func TestContentTypeMultipleValues(t *testing.T) {
+	config := testConfig()
+	for values, want := range map[string]string{
+		"text/html,image/png": "gzip",
+		"image/png,text/html": "",
+		";;;":                 "",
+	} {
+		engine := testEngine(config, func(ctx *gin.Context) {
+			for _, val := range strings.Split(values, ",") {
+				ctx.Writer.Header().Add("Content-Type", val)
+			}
+			ctx.Writer.Write([]byte(testBody))
+		})
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", values, val, want)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	config := testConfig()
+	config.MinLength = 0
+	config.Types = append(config.Types, "text/event-stream")
+	step := make(chan struct{})
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/event-stream")
+		i := 0
+		ctx.Stream(func(w io.Writer) bool {
+			<-step
+			i++
+			fmt.Fprintf(w, "data: frame %d\n\n", i)
+			return i < 3
+		})
+	})
+
+	for _, encoding := range []string{"gzip", "br"} {
+		go func() { step <- struct{}{} }()
+		res, reader := serveStream(t, engine, "/", encoding)
+		if val := res.Header.Get("Content-Encoding"); val != encoding {
+			t.Fatalf("Content-Encoding = %q, want %s", val, encoding)
+		}
+		// 每帧都要在下一帧写入之前到达客户端
+		buf := make([]byte, 100)
+		for i := 1; i <= 3; i++ {
+			n, err := reader.Read(buf)
+			if want := fmt.Sprintf("data: frame %d\n\n", i); string(buf[:n]) != want {
+				t.Fatalf("%s frame %d = %q %v", encoding, i, buf[:n], err)
+			}
+			if i < 3 {
+				go func() { step <- struct{}{} }()
+			}
+		}
+	}
+}
+
+func TestSSEvent(t *testing.T) {
+	config := PresetBalanced()
+	config.MinLength = 0
+	next := make(chan struct{})
+	engine := testEngine(config, func(ctx *gin.Context) {
+		for i := 0; i < 5; i++ {
+			ctx.SSEvent("msg", fmt.Sprintf("n%d", i))
+			ctx.Writer.Flush()
+			<-next
+		}
+	})
+
+	for _, encoding := range []string{"gzip", "br"} {
+		res, reader := serveStream(t, engine, "/", encoding)
+		if val := res.Header.Get("Content-Encoding"); val != encoding {
+			t.Fatalf("Content-Encoding = %q, want %s", val, encoding)
+		}
+		scanner := bufio.NewScanner(reader)
+		for i := 0; i < 5; i++ {
+			var lines [3]string
+			for j := range lines {
+				scanner.Scan()
+				lines[j] = scanner.Text()
+			}
+			if lines[0] != "event:msg" || lines[1] != fmt.Sprintf("data:n%d", i) {
+				t.Fatalf("%s event %d = %q", encoding, i, lines)
+			}
+			next <- struct{}{}
+		}
+	}
+}
+
+func TestSSELatency(t *testing.T) {
+	config := PresetBalanced()
+	config.MinLength = 0
+	config.EnableZstd = true
+	config.EnableSnappy = true
+	newHandler := func(next <-chan struct{}) http.Handler {
+		return testEngine(config, func(ctx *gin.Context) {
+			for i := 0; i < 5; i++ {
+				<-next
+				ctx.SSEvent("msg", fmt.Sprintf("n%d", i))
+				ctx.Writer.Flush()
+			}
+		})
+	}
+	for _, encoding := range []string{"gzip", "br", "zstd", "x-snappy-framed"} {
+		timing := compresstest.AssertSSELatency(t, newHandler, encoding, 5, time.Second)
+		if timing.Encoding != encoding || timing.Events[4] != "event:msg\ndata:n4" {
+			t.Fatalf("%s: %q events %q", encoding, timing.Encoding, timing.Events)
+		}
+	}
+}
+
+// 每个事件都小于 MinLength, 流式响应不缓存 第一次写入 (刷新之前) 就决定压缩
+func TestSSEBelowMinLength(t *testing.T) {
+	config := PresetBalanced()
+	config.MinLength = 4096
+	var mu sync.Mutex
+	var decided []string
+	newHandler := func(next <-chan struct{}) http.Handler {
+		return testEngine(config, func(ctx *gin.Context) {
+			for i := 0; i < 5; i++ {
+				<-next
+				ctx.SSEvent("msg", fmt.Sprintf("n%d", i))
+				mu.Lock()
+				decided = append(decided, ctx.Writer.Header().Get("Content-Encoding"))
+				mu.Unlock()
+				ctx.Writer.Flush()
+			}
+		})
+	}
+	for _, encoding := range []string{"gzip", "br"} {
+		mu.Lock()
+		decided = nil
+		mu.Unlock()
+		timing := compresstest.AssertSSELatency(t, newHandler, encoding, 5, time.Second)
+		if timing.Encoding != encoding || timing.Events[0] != "event:msg\ndata:n0" {
+			t.Fatalf("%s: %q events %q", encoding, timing.Encoding, timing.Events)
+		}
+		mu.Lock()
+		if len(decided) == 0 || decided[0] != encoding {
+			t.Fatalf("%s: Content-Encoding before flush %q", encoding, decided)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	config := PresetBalanced()
+	config.MinLength = 0
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "application/x-ndjson")
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(ctx.Writer, "{\"i\":%d}\n", i)
+			ctx.Writer.Flush()
+		}
+	})
+
+	for _, encoding := range []string{"gzip", "br"} {
+		res, reader := serveStream(t, engine, "/", encoding)
+		if val := res.Header.Get("Content-Encoding"); val != encoding {
+			t.Fatalf("Content-Encoding = %q, want %s", val, encoding)
+		}
+		scanner := bufio.NewScanner(reader)
+		n := 0
+		for ; scanner.Scan(); n++ {
+			if want := fmt.Sprintf("{\"i\":%d}", n); scanner.Text() != want {
+				t.Fatalf("%s line %d = %q", encoding, n, scanner.Text())
+			}
+		}
+		if n != 100 {
+			t.Fatalf("%s: %d lines, want 100", encoding, n)
+		}
+	}
+}
+
+func TestJSONArrayStream(t *testing.T) {
+	type item struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	want := make([]item, 10000)
+	for i := range want {
+		want[i] = item{i, fmt.Sprintf("item-%d", i)}
+	}
+	config := PresetBalanced()
+	config.MinLength = 0
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "application/json")
+		ctx.Writer.WriteString("[")
+		encoder := json.NewEncoder(ctx.Writer)
+		for i, item := range want {
+			if i > 0 {
+				ctx.Writer.WriteString(",")
+			}
+			encoder.Encode(item)
+			if i%100 == 99 {
+				ctx.Writer.Flush()
+			}
+		}
+		ctx.Writer.WriteString("]")
+	})
+
+	res, reader := serveStream(t, engine, "/", "br")
+	if val := res.Header.Get("Content-Encoding"); val != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", val)
+	}
+	// 读完整个流 结尾的 ] 之后不能有多余内容
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []item
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded %d items, want %d", len(got), len(want))
+	}
+}
+
+func TestDataFromReaderUnknownLength(t *testing.T) {
+	for _, compressUnknownLength := range []bool{false, true} {
+		config := testConfig()
+		config.CompressUnknownLength = compressUnknownLength
+		engine := testEngine(config, func(ctx *gin.Context) {
+			ctx.DataFromReader(http.StatusOK, -1, "text/plain", iotest.OneByteReader(strings.NewReader(testBody)), map[string]string{})
+		})
+		res, reader := serveStream(t, engine, "/", "gzip")
+		body, err := ioutil.ReadAll(reader)
+		if err != nil || string(body) != testBody {
+			t.Fatalf("%v: %d bytes %v", compressUnknownLength, len(body), err)
+		}
+		want := ""
+		if compressUnknownLength {
+			want = "gzip"
+		}
+		if val := res.Header.Get("Content-Encoding"); val != want {
+			t.Fatalf("%v: Content-Encoding = %q, want %q", compressUnknownLength, val, want)
+		}
+	}
+}
+
+func TestInvalidContentLength(t *testing.T) {
+	for _, compressUnknownLength := range []bool{false, true} {
+		var stats CompressStats
+		config := testConfig()
+		config.CompressUnknownLength = compressUnknownLength
+		config.OnComplete = func(val CompressStats) {
+			stats = val
+		}
+		engine := testEngine(config, func(ctx *gin.Context) {
+			ctx.Writer.Header()["Content-Length"] = []string{ctx.Query("length")}
+			ctx.Data(http.StatusOK, "text/plain", []byte(testBody))
+		})
+		for _, length := range []string{"abc", "-5", "99999999999999999999999"} {
+			compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/?length="+length, "gzip"), []byte(testBody))
+			if compressUnknownLength && stats.Skipped || !compressUnknownLength && stats.SkipReason != SkipUnknownLength {
+				t.Fatalf("%s %v: stats = %+v", length, compressUnknownLength, stats)
+			}
+		}
+	}
+}
+
+func TestOriginalSize(t *testing.T) {
+	var size, originalSize int
+	engine := gin.New()
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Next()
+		size = ctx.Writer.Size()
+		originalSize = ctx.Writer.(interface{ OriginalSize() int }).OriginalSize()
+	})
+	engine.Use(Compress(testConfig()))
+	engine.GET("/", stringHandler(testBody))
+
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	if size != recorder.Body.Len() || originalSize != len(testBody) {
+		t.Fatalf("size %d originalSize %d, want %d %d", size, originalSize, recorder.Body.Len(), len(testBody))
+	}
+}
+
+func TestDisableGzip(t *testing.T) {
+	config := testConfig()
+	config.DisableGzip = true
+	engine := testEngine(config, stringHandler(testBody))
+	for acceptEncoding, want := range map[string]string{
+		"gzip":     "",
+		"gzip, br": "br",
+	} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", acceptEncoding), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", acceptEncoding, val, want)
+		}
+	}
+}
+
+func TestConfigCopied(t *testing.T) {
+	config := testConfig()
+	engine := testEngine(config, stringHandler(testBody))
+
+	// 创建后修改配置的切片不影响中间件
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			config.Types[0] = "image/png"
+			config.Types = append(config.Types, "image/gif")
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+			t.Fatalf("Content-Encoding = %q, want gzip", val)
+		}
+	}
+	<-done
+}
+
+func TestNegotiate(t *testing.T) {
+	config := testConfig()
+	config.EnableZstd = true
+	for acceptEncoding, want := range map[string]string{
+		"x-gzip":                           "gzip",
+		"br;q=1.0;foo=bar":                 "br",
+		"gzip;foo=bar;q=0.5":               "gzip",
+		"zstd;q=0, gzip ; q=0.9 ; x=y":     "gzip",
+		"br;q=0":                           "",
+		"br;foo":                           "br",
+		"gzip;q=0.5, br;q=0.8, zstd;q=0.7": "br",
+		"gzip;q=1, br;q=0.1":               "gzip",
+		"gzip;q=0.9, br;q=0.9":             "br",
+		"gzip, zstd;q=0.999":               "gzip",
+		"br;q=0.5, zstd":                   "zstd",
+		"identity":                         "",
+		"GZIP":                             "gzip",
+		"BR":                               "br",
+		"Gzip;Q=0, Zstd":                   "zstd",
+		"X-Gzip":                           "gzip",
+		"IDENTITY":                         "",
+	} {
+		engine := testEngine(config, stringHandler(testBody))
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", acceptEncoding), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", acceptEncoding, val, want)
+		}
+	}
+}
+
+func TestBrotliRequireTLS(t *testing.T) {
+	config := testConfig()
+	config.BrotliRequireTLS = true
+	engine := testEngine(config, stringHandler(testBody))
+	for name, test := range map[string]struct {
+		tls            bool
+		acceptEncoding string
+		want           string
+	}{
+		"plaintext":      {false, "br, gzip", "gzip"},
+		"plaintext br":   {false, "br", ""},
+		"tls":            {true, "br, gzip", "br"},
+		"tls gzip first": {true, "gzip, br", "br"},
+	} {
+		req := testRequest("GET", "/", test.acceptEncoding)
+		if test.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		recorder := compresstest.AssertRoundTrip(t, engine, req, []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != test.want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", name, val, test.want)
+		}
+	}
+}
+
+func TestPreferredEncoding(t *testing.T) {
+	config := testConfig()
+	config.EnableZstd = true
+	config.SkipUserAgents = []string{"curl"}
+	config.ExcludeExtensions = []string{".png"}
+	engine := testEngine(config, stringHandler(testBody))
+	for _, test := range []struct {
+		method, target, acceptEncoding, userAgent string
+	}{
+		{"GET", "/", "gzip", ""},
+		{"GET", "/", "gzip, br", ""},
+		{"GET", "/", "GZIP;q=0.5, Zstd", ""},
+		{"GET", "/", "gzip;q=1, br;q=0.1", ""},
+		{"GET", "/", "br;q=0, gzip", ""},
+		{"GET", "/", "x-gzip", ""},
+		{"GET", "/", "deflate", ""},
+		{"GET", "/", "", ""},
+		{"GET", "/a.png", "br", ""},
+		{"GET", "/", "br", "curl/8.0"},
+		{"POST", "/", "br", ""},
+		{"OPTIONS", "/", "br", ""},
+	} {
+		req := testRequest(test.method, test.target, test.acceptEncoding)
+		if test.userAgent != "" {
+			req.Header.Set("User-Agent", test.userAgent)
+		}
+		preferred := PreferredEncoding(req, config)
+		recorder := compresstest.AssertRoundTrip(t, engine, req, []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != preferred {
+			t.Fatalf("%+v: PreferredEncoding = %q, middleware %q", test, preferred, val)
+		}
+	}
+}
+
+func TestCacheKeyEncoding(t *testing.T) {
+	config := testConfig()
+	config.EnableZstd = true
+	engine := testEngine(config, stringHandler(testBody))
+	for _, test := range []struct {
+		want            string
+		acceptEncodings []string
+	}{
+		{"br", []string{"br", "BR", "gzip, br", "br;q=1, gzip;q=0.5", "gzip;Q=0.5, Br"}},
+		{"gzip", []string{"gzip", "x-gzip", "GZip", "br;q=0, gzip", "deflate, x-gzip;q=0.8"}},
+		{"zstd", []string{"zstd", "zstd, gzip;q=0.5", "gzip;q=0.1, ZSTD;q=0.9"}},
+		{"identity", []string{"", "identity", "deflate", "br;q=0, gzip;q=0"}},
+	} {
+		for _, acceptEncoding := range test.acceptEncodings {
+			req := testRequest("GET", "/", acceptEncoding)
+			key := CacheKeyEncoding(req, config)
+			if key != test.want {
+				t.Fatalf("%q: CacheKeyEncoding = %q, want %s", acceptEncoding, key, test.want)
+			}
+			// 和中间件的选择一致
+			recorder := compresstest.AssertRoundTrip(t, engine, req, []byte(testBody))
+			if val := recorder.Header().Get("Content-Encoding"); val != key && (val != "" || key != "identity") {
+				t.Fatalf("%q: CacheKeyEncoding = %q, middleware %q", acceptEncoding, key, val)
+			}
+		}
+	}
+}
+
+func TestLegacyBrotliToken(t *testing.T) {
+	for _, accept := range []bool{false, true} {
+		config := testConfig()
+		config.AcceptLegacyBrotliToken = accept
+		engine := testEngine(config, stringHandler(testBody))
+		want := ""
+		if accept {
+			want = "br"
+		}
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "x-br"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%v: Content-Encoding = %q, want %q", accept, val, want)
+		}
+	}
+}
+
+func TestConnectionUpgrade(t *testing.T) {
+	engine := testEngine(testConfig(), stringHandler(testBody))
+	for connection, want := range map[string]string{
+		"keep-alive, Upgrade":  "",
+		"keep-alive, upgrades": "gzip",
+	} {
+		req := testRequest("GET", "/", "gzip")
+		req.Header.Set("Connection", connection)
+		recorder := compresstest.AssertRoundTrip(t, engine, req, []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", connection, val, want)
+		}
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	config := testConfig()
+	config.MinLength = 0
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Redirect(http.StatusFound, "/next")
+	})
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, testRequest("GET", "/", "gzip"))
+	if recorder.Code != http.StatusFound || recorder.Header().Get("Location") != "/next" || recorder.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("got %d %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestIdentityEncoding(t *testing.T) {
+	engine := testEngine(testConfig(), func(ctx *gin.Context) {
+		ctx.Header("Content-Encoding", "identity")
+		ctx.String(http.StatusOK, testBody)
+	})
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	if _, ok := recorder.Header()["Content-Encoding"]; ok {
+		t.Fatalf("header = %v, want no Content-Encoding", recorder.Header())
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	for _, minLength := range []int64{0, 10} {
+		for _, debug := range []bool{false, true} {
+			config := testConfig()
+			config.MinLength = minLength
+			config.Debug = debug
+			for name, handler := range map[string]gin.HandlerFunc{
+				"status": func(ctx *gin.Context) {
+					ctx.Header("Content-Type", "text/html")
+					ctx.Status(http.StatusOK)
+				},
+				"nil data": func(ctx *gin.Context) {
+					ctx.Data(http.StatusOK, "text/html", nil)
+				},
+				"flush": func(ctx *gin.Context) {
+					ctx.Header("Content-Type", "text/html")
+					ctx.Writer.Write(nil)
+					ctx.Writer.Flush()
+				},
+			} {
+				engine := testEngine(config, handler)
+				recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), nil)
+				if recorder.Header().Get("Content-Encoding") != "" || recorder.Header().Get("X-Compress-Encoded-Size") != "" {
+					t.Fatalf("%s %d %v: header = %v", name, minLength, debug, recorder.Header())
+				}
+			}
+		}
+	}
+}
+
+func TestEmptyBodyRestoresContentLength(t *testing.T) {
+	engine := testEngine(testConfig(), func(ctx *gin.Context) {
+		ctx.Header("Content-Length", "5000")
+		ctx.Header("Accept-Ranges", "bytes")
+		ctx.Data(http.StatusOK, "text/html", nil)
+	})
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), nil)
+	if recorder.Header().Get("Content-Encoding") != "" || recorder.Header().Get("Content-Length") != "5000" || recorder.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("header = %v", recorder.Header())
+	}
+}
+
+type slowWriter struct {
+	gin.ResponseWriter
+}
+
+func (w *slowWriter) Write(data []byte) (int, error) {
+	time.Sleep(3 * time.Millisecond)
+	return w.ResponseWriter.Write(data)
+}
+
+func TestTimeout(t *testing.T) {
+	var stats CompressStats
+	config := testConfig()
+	config.Timeout = 2 * time.Millisecond
+	config.OnComplete = func(val CompressStats) {
+		stats = val
+	}
+	engine := gin.New()
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Writer = &slowWriter{ctx.Writer}
+		ctx.Next()
+	})
+	engine.Use(Compress(config))
+	payload := strings.Repeat("abcdefgh", 100000)
+	engine.GET("/", func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/html")
+		for i := 0; i < 10; i++ {
+			ctx.Writer.Write([]byte(payload[i*80000 : (i+1)*80000]))
+		}
+	})
+
+	// 超时后降级为不压缩的 gzip 仍然是完整的 gzip 流
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(payload))
+	if stats.Encoding != "gzip" || recorder.Body.Len() < len(payload)/2 {
+		t.Fatalf("stats = %+v, %d bytes", stats, recorder.Body.Len())
+	}
+	// 只有一个 gzip 成员 只解码第一个成员的客户端也能得到完整内容
+	reader, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Multistream(false)
+	body, err := ioutil.ReadAll(reader)
+	if err != nil || string(body) != payload {
+		t.Fatalf("first member: %d bytes %v", len(body), err)
+	}
+	if _, err := gzip.NewReader(recorder.Body); err != io.EOF {
+		t.Fatalf("second member: %v", err)
+	}
+}
+
+func TestZstdDict(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 500; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id":%d,"name":"user-%d","email":"user%d@example.com","active":true,"roles":["reader","writer"]}`, i, i*7, i*13)))
+	}
+	zstdDict, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := map[bool]int{}
+	for _, withDict := range []bool{false, true} {
+		config := testConfig()
+		config.MinLength = 0
+		config.EnableZstd = true
+		var options []zstd.DOption
+		if withDict {
+			config.ZstdDict = zstdDict
+			options = append(options, zstd.WithDecoderDicts(zstdDict))
+		}
+		decoder, err := zstd.NewReader(nil, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+
+		engine := testEngine(config, func(ctx *gin.Context) {
+			i, _ := strconv.Atoi(ctx.Query("i"))
+			ctx.Data(http.StatusOK, "application/json", samples[i])
+		})
+		for i := 0; i < 50; i++ {
+			recorder := httptest.NewRecorder()
+			engine.ServeHTTP(recorder, testRequest("GET", "/?i="+strconv.Itoa(i), "gzip, zstd"))
+			if val := recorder.Header().Get("Content-Encoding"); val != "zstd" {
+				t.Fatalf("Content-Encoding = %q, want zstd", val)
+			}
+			body, err := decoder.DecodeAll(recorder.Body.Bytes(), nil)
+			if err != nil || !bytes.Equal(body, samples[i]) {
+				t.Fatalf("decode %v", err)
+			}
+			sizes[withDict] += recorder.Body.Len()
+		}
+	}
+	if sizes[true] >= sizes[false] {
+		t.Fatalf("dict %d bytes, without %d bytes", sizes[true], sizes[false])
+	}
+}
+
+func TestAdaptiveCodec(t *testing.T) {
+	config := testConfig()
+	config.AdaptiveCodec = true
+	engine := testEngine(config, func(ctx *gin.Context) {
+		n, _ := strconv.Atoi(ctx.Query("n"))
+		ctx.Header("Content-Length", strconv.Itoa(n))
+		ctx.String(http.StatusOK, strings.Repeat("x", n))
+	})
+	for _, test := range []struct {
+		n              int
+		acceptEncoding string
+		want           string
+	}{
+		{100, "gzip, br", "gzip"},
+		{1023, "gzip, br", "gzip"},
+		{1024, "gzip, br", "br"},
+		{100, "br", "br"},
+	} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/?n="+strconv.Itoa(test.n), test.acceptEncoding), []byte(strings.Repeat("x", test.n)))
+		if val := recorder.Header().Get("Content-Encoding"); val != test.want {
+			t.Fatalf("%d %s: Content-Encoding = %q, want %s", test.n, test.acceptEncoding, val, test.want)
+		}
+	}
+
+	// 没有声明长度的模板分多次写入 第一次写入很短也不代表总长度
+	page := strings.Repeat("<p>hello world</p>", 100*1024/18)
+	for _, minLength := range []int64{0, 10, 100} {
+		config := testConfig()
+		config.AdaptiveCodec = true
+		config.MinLength = minLength
+		engine := testEngine(config, func(ctx *gin.Context) {
+			ctx.Header("Content-Type", "text/html")
+			for i := 0; i < len(page); i += 200 {
+				end := i + 200
+				if end > len(page) {
+					end = len(page)
+				}
+				ctx.Writer.WriteString(page[i:end])
+			}
+		})
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip, br"), []byte(page))
+		if val := recorder.Header().Get("Content-Encoding"); val != "br" {
+			t.Fatalf("min length %d: Content-Encoding = %q, want br", minLength, val)
+		}
+	}
+}
+
+func TestCodecByType(t *testing.T) {
+	config := testConfig()
+	config.EnableZstd = true
+	config.Types = DefaultTypes
+	config.CodecByType = map[string]string{
+		"text/html":        "br",
+		"Application/JSON": "gzip",
+		"text/css":         "zstd",
+	}
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, ctx.Query("type"), []byte(testBody))
+	})
+	for _, test := range []struct {
+		typ, acceptEncoding, want string
+	}{
+		{"text/html; charset=utf-8", "gzip, br", "br"},
+		{"application/json", "br, gzip", "gzip"},
+		{"application/json", "zstd, br", "br"},
+		{"text/css", "br, gzip", "br"},
+		{"text/css", "br, zstd", "zstd"},
+		{"text/plain", "br, gzip", "br"},
+	} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/?type="+url.QueryEscape(test.typ), test.acceptEncoding), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != test.want {
+			t.Fatalf("%s %s: Content-Encoding = %q, want %q", test.typ, test.acceptEncoding, val, test.want)
+		}
+	}
+}
+
+func TestHuffmanOnly(t *testing.T) {
+	config := testConfig()
+	config.GzipLevel = gzip.HuffmanOnly
+	engine := testEngine(config, stringHandler(testBody))
+	for i := 0; i < 3; i++ {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+			t.Fatalf("Content-Encoding = %q, want gzip", val)
+		}
+	}
+}
+
+func TestGzipLevelDefault(t *testing.T) {
+	config := testConfig()
+	config.GzipLevel = 0
+	config.Debug = true
+	engine := testEngine(config, stringHandler(testBody))
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	if val := recorder.Header().Get("X-Compress-Info"); val != "gzip;level=-1" {
+		t.Fatalf("X-Compress-Info = %q", val)
+	}
+	if recorder.Body.Len()*4 > len(testBody) {
+		t.Fatalf("compressed %d bytes of %d", recorder.Body.Len(), len(testBody))
+	}
+
+	// 单个请求的覆盖配置同样处理
+	config.GzipLevel = gzip.BestSpeed
+	config.PerRequest = func(ctx *gin.Context) *Config {
+		override := config
+		override.GzipLevel = 0
+		return &override
+	}
+	engine = testEngine(config, stringHandler(testBody))
+	recorder = compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	if val := recorder.Header().Get("X-Compress-Info"); val != "gzip;level=-1" {
+		t.Fatalf("override X-Compress-Info = %q", val)
+	}
+}
+
+func TestUseGroup(t *testing.T) {
+	engine := gin.New()
+	Use(engine.Group("/api"), testConfig()).GET("/x", stringHandler(testBody))
+	engine.GET("/x", stringHandler(testBody))
+	for target, want := range map[string]string{
+		"/api/x": "gzip",
+		"/x":     "",
+	} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", target, val, want)
+		}
+	}
+}
+
+func TestOptionsNoVary(t *testing.T) {
+	engine := testEngine(testConfig(), stringHandler(testBody))
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("OPTIONS", "/", "gzip"), []byte(testBody))
+	if recorder.Header().Get("Vary") != "" || recorder.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("header = %v", recorder.Header())
+	}
+}
+
+// CORS 中间件用带内容的响应回复预检请求 任何配置下都不压缩也不设置 Vary
+func TestOptionsWithBody(t *testing.T) {
+	cors := func(ctx *gin.Context) {
+		if ctx.Request.Method == http.MethodOptions {
+			ctx.Header("Access-Control-Allow-Origin", "*")
+			ctx.Data(http.StatusOK, "text/plain", []byte(testBody))
+			ctx.Abort()
+		}
+	}
+	for name, change := range map[string]func(config *Config){
+		"default":               func(config *Config) {},
+		"all methods":           func(config *Config) { config.Methods = []string{"*"} },
+		"explicit options":      func(config *Config) { config.Methods = []string{"GET", "OPTIONS"} },
+		"vary only compressed":  func(config *Config) { config.VaryOnlyWhenCompressed = true },
+		"always content length": func(config *Config) { config.AlwaysContentLength = true },
+		"sniff octet stream":    func(config *Config) { config.SniffOverrideOctetStream = true },
+		"transcode with gzip":   func(config *Config) { config.Transcode = true },
+		"wildcard types":        func(config *Config) { config.Types = []string{"*"} },
+	} {
+		config := testConfig()
+		config.EnableZstd = true
+		change(&config)
+		engine := gin.New()
+		engine.Use(Compress(config), cors)
+		engine.Handle(http.MethodOptions, "/", func(ctx *gin.Context) {})
+		for _, encoding := range []string{"gzip", "br", "zstd"} {
+			recorder := compresstest.AssertRoundTrip(t, engine, testRequest("OPTIONS", "/", encoding), []byte(testBody))
+			if recorder.Header().Get("Vary") != "" || recorder.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("%s %s: header = %v", name, encoding, recorder.Header())
+			}
+		}
+
+		// 标准库中间件同样
+		handler := Handler(config)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(testBody))
+		}))
+		recorder := compresstest.AssertRoundTrip(t, handler, testRequest("OPTIONS", "/", "gzip"), []byte(testBody))
+		if recorder.Header().Get("Vary") != "" || recorder.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("%s handler: header = %v", name, recorder.Header())
+		}
+	}
+}
+
+func TestSnappy(t *testing.T) {
+	config := testConfig()
+	config.EnableSnappy = true
+	engine := testEngine(config, stringHandler(testBody))
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "x-snappy-framed"), []byte(testBody))
+	if val := recorder.Header().Get("Content-Encoding"); val != "x-snappy-framed" {
+		t.Fatalf("Content-Encoding = %q, want x-snappy-framed", val)
+	}
+}
+
+func TestFlushThenClose(t *testing.T) {
+	config := testConfig()
+	config.EnableZstd = true
+	config.EnableSnappy = true
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/plain")
+		ctx.Writer.Write([]byte(testBody[:1200]))
+		ctx.Writer.Flush()
+		ctx.Writer.Write([]byte(testBody[1200:]))
+	})
+	for _, encoding := range []string{"gzip", "br", "zstd", "x-snappy-framed"} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", encoding), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != encoding {
+			t.Fatalf("Content-Encoding = %q, want %s", val, encoding)
+		}
+	}
+}
+
+func TestPerRequestQuality(t *testing.T) {
+	var payload strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&payload, `{"id":%d,"v":"%x"},`, i, i*7919)
+	}
+	config := testConfig()
+	config.GzipLevel = gzip.BestSpeed
+	config.PerRequest = func(ctx *gin.Context) *Config {
+		if ctx.GetHeader("Authorization") == "" {
+			return nil
+		}
+		override := testConfig()
+		override.GzipLevel = gzip.BestCompression
+		return &override
+	}
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/json", []byte(payload.String()))
+	})
+
+	fast := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(payload.String()))
+	req := testRequest("GET", "/", "gzip")
+	req.Header.Set("Authorization", "Bearer token")
+	best := compresstest.AssertRoundTrip(t, engine, req, []byte(payload.String()))
+	if best.Body.Len() >= fast.Body.Len() {
+		t.Fatalf("best %d bytes, fast %d bytes", best.Body.Len(), fast.Body.Len())
+	}
+}
+
+func TestWriteHeaderNowBeforeWrite(t *testing.T) {
+	engine := testEngine(testConfig(), func(ctx *gin.Context) {
+		ctx.Status(http.StatusCreated)
+		ctx.Writer.WriteHeaderNow()
+		ctx.String(http.StatusCreated, testBody)
+	})
+	for _, encoding := range []string{"gzip", "br"} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", encoding), []byte(testBody))
+		if recorder.Code != http.StatusCreated || recorder.Header().Get("Content-Encoding") != encoding {
+			t.Fatalf("got %d %v", recorder.Code, recorder.Header())
+		}
+	}
+}
+
+// 内层中间件在处理函数没有写入时输出错误, 压缩与否都不能覆盖已经决定的响应
+func TestWrittenFallback(t *testing.T) {
+	for name, test := range map[string]struct {
+		handler gin.HandlerFunc
+		code    int
+		body    string
+	}{
+		"abort":    {func(ctx *gin.Context) { ctx.AbortWithStatus(http.StatusUnauthorized) }, http.StatusUnauthorized, ""},
+		"buffered": {stringHandler("ok"), http.StatusOK, "ok"},
+	} {
+		config := testConfig()
+		config.MinLength = 1024
+		engine := gin.New()
+		engine.Use(Compress(config))
+		engine.Use(func(ctx *gin.Context) {
+			ctx.Next()
+			if !ctx.Writer.Written() {
+				ctx.String(http.StatusInternalServerError, "fallback error")
+			}
+		})
+		engine.GET("/", test.handler)
+		for _, encoding := range []string{"", "gzip", "br"} {
+			recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", encoding), []byte(test.body))
+			if recorder.Code != test.code || recorder.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("%s %q: got %d %v", name, encoding, recorder.Code, recorder.Header())
+			}
+		}
+	}
+}
+
+// 状态码和是否压缩无关: 头发送之前后面的调用覆盖前面的, 发送之后的调用被忽略
+func TestWriteHeaderTwice(t *testing.T) {
+	var logged int
+	config := testConfig()
+	config.Logger = func(format string, args ...interface{}) {
+		logged++
+	}
+	for name, test := range map[string]struct {
+		handler gin.HandlerFunc
+		code    int
+		logged  int
+	}{
+		"overwrite": {func(ctx *gin.Context) {
+			ctx.Header("Content-Type", "text/plain")
+			ctx.Writer.WriteHeader(http.StatusCreated)
+			ctx.Writer.WriteHeader(http.StatusAccepted)
+			ctx.Writer.WriteString(testBody)
+		}, http.StatusAccepted, 0},
+		// ctx.String 设置的状态码直接写入 gin 的 writer
+		"gin status": {func(ctx *gin.Context) {
+			ctx.Writer.WriteHeader(http.StatusCreated)
+			ctx.Writer.WriteHeader(http.StatusNotModified)
+			ctx.String(http.StatusOK, testBody)
+		}, http.StatusOK, 0},
+		"after flush": {func(ctx *gin.Context) {
+			ctx.Header("Content-Type", "text/plain")
+			ctx.Writer.WriteHeader(http.StatusCreated)
+			ctx.Writer.WriteString(testBody)
+			ctx.Writer.Flush()
+			ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusCreated, 1},
+	} {
+		engine := testEngine(config, test.handler)
+		for _, encoding := range []string{"", "gzip", "br"} {
+			logged = 0
+			recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", encoding), []byte(testBody))
+			if recorder.Code != test.code || recorder.Header().Get("Content-Encoding") != encoding {
+				t.Fatalf("%s %q: got %d %v", name, encoding, recorder.Code, recorder.Header())
+			}
+			if encoding != "" && logged != test.logged {
+				t.Fatalf("%s %q: logged %d, want %d", name, encoding, logged, test.logged)
+			}
+		}
+	}
+}
+
+func TestExcludeExtensions(t *testing.T) {
+	config := testConfig()
+	config.ExcludeExtensions = []string{"png", ".ZIP"}
+	engine := testEngine(config, stringHandler(testBody))
+	for target, want := range map[string]string{
+		"/img/logo.png":     "",
+		"/img/a.zip":        "",
+		"/img/a.txt":        "gzip",
+		"/img/a.png/detail": "gzip",
+		"/img/a.txt?f=.png": "gzip",
+	} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", target, val, want)
+		}
+		if want == "" && recorder.Header().Get("Vary") != "" {
+			t.Fatalf("%s: Vary = %q, want none", target, recorder.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestSkipPredicate(t *testing.T) {
+	config := testConfig()
+	config.Skip = func(ctx *gin.Context) bool {
+		return ctx.Query("raw") == "1" || ctx.GetString("user") == "admin"
+	}
+	engine := gin.New()
+	engine.Use(func(ctx *gin.Context) {
+		if val := ctx.Query("user"); val != "" {
+			ctx.Set("user", val)
+		}
+	})
+	engine.Use(Compress(config))
+	engine.GET("/", stringHandler(testBody))
+	for target, want := range map[string]string{
+		"/?raw=1":      "",
+		"/?user=admin": "",
+		"/?user=bob":   "gzip",
+		"/":            "gzip",
+	} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", target, val, want)
+		}
+		if want == "" && recorder.Header().Get("Vary") != "" {
+			t.Fatalf("%s: Vary = %q, want none", target, recorder.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestMinLengthBuffer(t *testing.T) {
+	config := testConfig()
+	config.MinLength = 100
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/plain")
+		for _, val := range strings.Split(ctx.Query("parts"), ",") {
+			ctx.Writer.WriteString(val)
+		}
+	})
+	long := strings.TrimSuffix(strings.Repeat("hello ,", 30), ",")
+	for parts, want := range map[string]string{
+		long:    "gzip",
+		"hi,yo": "",
+	} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/?parts="+url.QueryEscape(parts), "gzip"), []byte(strings.Replace(parts, ",", "", -1)))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", parts, val, want)
+		}
+	}
+}
+
+func TestMaxBufferBytes(t *testing.T) {
+	for _, compressUnknownLength := range []bool{false, true} {
+		config := testConfig()
+		config.MinLength = 1000
+		config.MaxBufferBytes = 100
+		config.CompressUnknownLength = compressUnknownLength
+		engine := testEngine(config, func(ctx *gin.Context) {
+			ctx.Header("Content-Type", "text/plain")
+			for i := 0; i < 30; i++ {
+				ctx.Writer.WriteString("hello ")
+			}
+		})
+		// 超过 MaxBufferBytes 还没有达到 MinLength 按长度未知处理
+		want := ""
+		if compressUnknownLength {
+			want = "gzip"
+		}
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(strings.Repeat("hello ", 30)))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%v: Content-Encoding = %q, want %q", compressUnknownLength, val, want)
+		}
+	}
+}
+
+func TestBrotliDynamicQuality(t *testing.T) {
+	var quality int
+	newWriter := newBrotliWriter
+	defer func() {
+		newBrotliWriter = newWriter
+	}()
+	newBrotliWriter = func(dst io.Writer, options cbrotli.WriterOptions) (io.WriteCloser, error) {
+		quality = options.Quality
+		return newWriter(dst, options)
+	}
+
+	config := testConfig()
+	config.BrQuality = 11
+	config.BrotliMaxQualityForDynamic = 4
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Header("Cache-Control", ctx.Query("cache"))
+		ctx.String(http.StatusOK, testBody)
+	})
+	for cache, want := range map[string]int{
+		"":                     4,
+		"no-cache":             4,
+		"private, max-age=60":  4,
+		"max-age=0":            4,
+		"public, max-age=3600": 11,
+	} {
+		compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/?cache="+url.QueryEscape(cache), "br"), []byte(testBody))
+		if quality != want {
+			t.Fatalf("%q: quality = %d, want %d", cache, quality, want)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	for _, methods := range [][]string{nil, {"get", "POST"}, {"*"}} {
+		config := testConfig()
+		config.Methods = methods
+		engine := testEngine(config, stringHandler(testBody))
+		want := "gzip"
+		if methods == nil {
+			want = ""
+		}
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("POST", "/", "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%v POST: Content-Encoding = %q, want %q", methods, val, want)
+		}
+		recorder = compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+			t.Fatalf("%v GET: Content-Encoding = %q, want gzip", methods, val)
+		}
+	}
+}
+
+func benchmarkEngine(b *testing.B, config Config, handler gin.HandlerFunc) {
+	benchmarkServe(b, testEngine(config, handler))
+}
+
+func benchmarkServe(b *testing.B, engine *gin.Engine) {
+	req := testRequest("GET", "/", "gzip")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+// baseline 不经过 Compress, declared 声明了 Content-Length 在 open 时直接跳过
+func BenchmarkTinyResponse(b *testing.B) {
+	tiny := func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "tiny")
+		ctx.String(http.StatusOK, "tiny")
+		ctx.String(http.StatusOK, "tiny")
+	}
+	b.Run("baseline", func(b *testing.B) {
+		engine := gin.New()
+		engine.Any("/*path", tiny)
+		benchmarkServe(b, engine)
+	})
+	b.Run("undeclared", func(b *testing.B) {
+		benchmarkEngine(b, testConfig(), tiny)
+	})
+	b.Run("declared", func(b *testing.B) {
+		benchmarkEngine(b, testConfig(), func(ctx *gin.Context) {
+			ctx.Header("Content-Length", "12")
+			tiny(ctx)
+		})
+	})
+}
+
+// 只计算新建 compressor 之后的第一个请求, 预热的 writer 在创建时已经分配
+func BenchmarkPrewarmPool(b *testing.B) {
+	for _, encoding := range []string{"gzip", "zstd"} {
+		for _, n := range []int{0, 1} {
+			config := testConfig()
+			config.EnableZstd = true
+			config.PrewarmPool = n
+			b.Run(encoding+"/"+strconv.Itoa(n), func(b *testing.B) {
+				req := testRequest("GET", "/", encoding)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					compressor := newCompressor(config)
+					recorder := httptest.NewRecorder()
+					b.StartTimer()
+					writer, finish, _ := compressor.newWriter(recorder, req)
+					writer.Header().Set("Content-Type", "text/plain")
+					writer.Write([]byte(testBody))
+					finish()
+				}
+			})
+		}
+	}
+}
+
+// unpooled 每次请求换一个空的 bufferPool, 对比池减少的分配
+func BenchmarkBelowMinLength(b *testing.B) {
+	config := testConfig()
+	config.MinLength = 1024
+	for _, pooled := range []bool{true, false} {
+		name := "pooled"
+		if !pooled {
+			name = "unpooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			compressor := newCompressor(config)
+			newBuffer := compressor.bufferPool.New
+			req := testRequest("GET", "/", "gzip")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !pooled {
+					compressor.bufferPool = sync.Pool{New: newBuffer}
+				}
+				writer, finish, _ := compressor.newWriter(httptest.NewRecorder(), req)
+				writer.Header().Set("Content-Type", "text/plain")
+				writer.Write([]byte("hi"))
+				writer.Write([]byte("yo"))
+				finish()
+			}
+		})
+	}
+}
+
+func TestOnClose(t *testing.T) {
+	var calls int
+	var stats CompressStats
+	config := testConfig()
+	config.OnComplete = func(val CompressStats) {
+		stats = val
+	}
+	config.OnClose = func(ctx *gin.Context) {
+		calls++
+		// 在压缩结束之后调用
+		if stats.OriginalBytes == 0 && ctx.Request.URL.Path == "/body" {
+			t.Error("OnClose before OnComplete")
+		}
+	}
+	engine := gin.New()
+	engine.Use(recoveryJSON)
+	engine.Use(Compress(config))
+	engine.GET("/body", stringHandler(testBody))
+	engine.GET("/empty", func(ctx *gin.Context) {})
+	engine.GET("/panic", func(ctx *gin.Context) { panic("boom") })
+
+	for _, target := range []string{"/body", "/empty", "/panic", "/missing"} {
+		calls = 0
+		stats = CompressStats{}
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, testRequest("GET", target, "gzip"))
+		if calls != 1 {
+			t.Fatalf("%s: OnClose called %d times, want 1", target, calls)
+		}
+	}
+}
+
+func TestUnknownContentEncoding(t *testing.T) {
+	var stats CompressStats
+	config := testConfig()
+	config.OnComplete = func(val CompressStats) {
+		stats = val
+	}
+	for _, encoding := range []string{"compress", "x-custom", "gzip, x-custom"} {
+		engine := testEngine(config, func(ctx *gin.Context) {
+			ctx.Header("Content-Encoding", encoding)
+			ctx.String(http.StatusOK, testBody)
+		})
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, testRequest("GET", "/", "br, gzip"))
+		if val := recorder.Header()["Content-Encoding"]; len(val) != 1 || val[0] != encoding {
+			t.Fatalf("Content-Encoding = %q, want %q", val, encoding)
+		}
+		if recorder.Body.String() != testBody || stats.SkipReason != SkipAlreadyEncoded {
+			t.Fatalf("%s: %d bytes, stats = %+v", encoding, recorder.Body.Len(), stats)
+		}
+	}
+}
+
+func TestSniffOctetStream(t *testing.T) {
+	html := "<!DOCTYPE html><html><body>" + testBody + "</body></html>"
+	for _, sniff := range []bool{false, true} {
+		config := testConfig()
+		config.SniffOverrideOctetStream = sniff
+		config.MinLength = 100
+		engine := testEngine(config, func(ctx *gin.Context) {
+			// split 分次写入 先缓存再从缓存嗅探
+			if ctx.Query("split") == "" {
+				ctx.Data(http.StatusOK, "application/octet-stream", []byte(html))
+				return
+			}
+			ctx.Header("Content-Type", "application/octet-stream")
+			for i := 0; i < len(html); i += 20 {
+				ctx.Writer.WriteString(html[i:min(i+20, len(html))])
+			}
+		})
+
+		for _, target := range []string{"/", "/?split=1"} {
+			recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, "gzip"), []byte(html))
+			want, contentType := "", "application/octet-stream"
+			if sniff {
+				want, contentType = "gzip", "text/html; charset=utf-8"
+			}
+			if val := recorder.Header().Get("Content-Encoding"); val != want {
+				t.Fatalf("%s %v: Content-Encoding = %q, want %q", target, sniff, val, want)
+			}
+			if val := recorder.Header().Get("Content-Type"); val != contentType {
+				t.Fatalf("%s %v: Content-Type = %q, want %q", target, sniff, val, contentType)
+			}
+		}
+	}
+
+	// 嗅探出的类型不在 Types 中 保持原样
+	config := testConfig()
+	config.SniffOverrideOctetStream = true
+	payload := append([]byte("\x89PNG\x0d\x0a\x1a\x0a"), testBody...)
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/octet-stream", payload)
+	})
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), payload)
+	if recorder.Header().Get("Content-Encoding") != "" || recorder.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("header = %v", recorder.Header())
+	}
+}
+
+func TestEntropyCheck(t *testing.T) {
+	random := make([]byte, 6000)
+	rand.New(rand.NewSource(1)).Read(random)
+	encoded := base64.StdEncoding.EncodeToString(random)
+
+	for _, check := range []bool{false, true} {
+		var stats CompressStats
+		config := testConfig()
+		config.EntropyCheck = check
+		config.OnComplete = func(val CompressStats) {
+			stats = val
+		}
+		engine := testEngine(config, func(ctx *gin.Context) {
+			ctx.String(http.StatusOK, ctx.Query("body"))
+		})
+
+		for body, want := range map[string]string{
+			encoded:       "gzip",
+			testBody:      "gzip",
+			encoded[:200]: "gzip",
+		} {
+			if check && body == encoded {
+				want = ""
+			}
+			recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/?body="+url.QueryEscape(body), "gzip"), []byte(body))
+			if val := recorder.Header().Get("Content-Encoding"); val != want {
+				t.Fatalf("%v %d bytes: Content-Encoding = %q, want %q", check, len(body), val, want)
+			}
+			if want == "" && stats.SkipReason != SkipEntropy {
+				t.Fatalf("stats = %+v", stats)
+			}
+		}
+	}
+}
+
+func TestSingleTokenQZero(t *testing.T) {
+	config := testConfig()
+	config.EnableZstd = true
+	config.EnableSnappy = true
+	engine := testEngine(config, stringHandler(testBody))
+	for _, acceptEncoding := range []string{
+		"br;q=0",
+		"gzip;q=0",
+		"zstd;q=0",
+		"x-snappy-framed;q=0",
+		"x-gzip;q=0",
+		"br; q=0.0",
+		"gzip;q=0.000",
+		"br;level=1;q=0",
+	} {
+		req := testRequest("GET", "/", acceptEncoding)
+		if encoding := getEncoding(req, normalizeConfig(config)); encoding != "" {
+			t.Fatalf("%s: getEncoding = %q, want none", acceptEncoding, encoding)
+		}
+		recorder := compresstest.AssertRoundTrip(t, engine, req, []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != "" {
+			t.Fatalf("%s: Content-Encoding = %q, want none", acceptEncoding, val)
+		}
+	}
+}
+
+func TestBrotliLGWinDynamic(t *testing.T) {
+	var lgwin int
+	newWriter := newBrotliWriter
+	defer func() {
+		newBrotliWriter = newWriter
+	}()
+	newBrotliWriter = func(dst io.Writer, options cbrotli.WriterOptions) (io.WriteCloser, error) {
+		lgwin = options.LGWin
+		return newWriter(dst, options)
+	}
+
+	for _, dynamic := range []bool{false, true} {
+		config := testConfig()
+		config.BrLGWin = 24
+		config.BrLGWinDynamic = dynamic
+		compressor := newCompressor(config)
+		// 预先设置计数 模拟其他正在进行的 brotli 压缩
+		for active, want := range map[int64]int{0: 24, 15: 24, 16: 23, 40: 22, 1000: 18} {
+			atomic.StoreInt64(&compressor.brotli, active)
+			recorder := httptest.NewRecorder()
+			writer, finish, _ := compressor.newWriter(recorder, testRequest("GET", "/", "br"))
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.Write([]byte(testBody))
+			finish()
+			if !dynamic {
+				want = 24
+			}
+			if lgwin != want {
+				t.Fatalf("%v %d: lgwin = %d, want %d", dynamic, active, lgwin, want)
+			}
+			if val := atomic.LoadInt64(&compressor.brotli); val != active {
+				t.Fatalf("%v: active = %d after close, want %d", dynamic, val, active)
+			}
+			body, err := compresstest.Decode("br", recorder.Body.Bytes())
+			if err != nil || string(body) != testBody {
+				t.Fatalf("decode %v", err)
+			}
+		}
+	}
+}
+
+// 最小的自定义 render 分次写入 和内置的 render 一样在 Render 中设置类型
+type csvRender struct {
+	rows [][]string
+}
+
+func (r csvRender) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	for _, row := range r.rows {
+		if _, err := io.WriteString(w, strings.Join(row, ",")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r csvRender) WriteContentType(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+}
+
+func TestCustomRender(t *testing.T) {
+	var rows [][]string
+	var want strings.Builder
+	for i := 0; i < 200; i++ {
+		row := []string{strconv.Itoa(i), "name", "user@example.com"}
+		rows = append(rows, row)
+		want.WriteString(strings.Join(row, ",") + "\n")
+	}
+	config := testConfig()
+	config.Types = append(config.Types, "text/csv")
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Render(http.StatusOK, csvRender{rows: rows})
+	})
+	for _, encoding := range []string{"br", "gzip"} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", encoding), []byte(want.String()))
+		if val := recorder.Header().Get("Content-Encoding"); val != encoding {
+			t.Fatalf("Content-Encoding = %q, want %s", val, encoding)
+		}
+		if val := recorder.Header().Get("Content-Type"); val != "text/csv; charset=utf-8" {
+			t.Fatalf("Content-Type = %q", val)
+		}
+	}
+}
+
+// 标准库的客户端只发送 HTTP/1.1 直接写请求行
+func serveHTTP10(t *testing.T, server *httptest.Server, target, acceptEncoding string) (*http.Response, []byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s HTTP/1.0\r\nHost: %s\r\nConnection: keep-alive\r\nAccept-Encoding: %s\r\n\r\n", target, server.Listener.Addr(), acceptEncoding)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := compresstest.Decode(res.Header.Get("Content-Encoding"), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, body
+}
+
+func TestAllowHTTP10(t *testing.T) {
+	large := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(large)
+	handler := func(ctx *gin.Context) {
+		if ctx.Query("size") == "large" {
+			ctx.String(http.StatusOK, base64.StdEncoding.EncodeToString(large))
+			return
+		}
+		ctx.String(http.StatusOK, testBody)
+	}
+	config := testConfig()
+	server := httptest.NewServer(testEngine(config, handler))
+	defer server.Close()
+	res, body := serveHTTP10(t, server, "/", "gzip")
+	if val := res.Header.Get("Content-Encoding"); val != "" || string(body) != testBody {
+		t.Fatalf("default: Content-Encoding = %q", val)
+	}
+
+	config.AllowHTTP10 = true
+	config.MaxBufferBytes = 4096
+	server = httptest.NewServer(testEngine(config, handler))
+	defer server.Close()
+	for _, encoding := range []string{"gzip", "br"} {
+		// 设置了 Content-Length 连接保持
+		res, body := serveHTTP10(t, server, "/", encoding)
+		if res.Header.Get("Content-Encoding") != encoding || res.ContentLength <= 0 || res.Close || string(body) != testBody {
+			t.Fatalf("%s: Content-Length %d close %v %d bytes", encoding, res.ContentLength, res.Close, len(body))
+		}
+
+		// 超过 MaxBufferBytes 由关闭连接结束
+		res, body = serveHTTP10(t, server, "/?size=large", encoding)
+		if res.Header.Get("Content-Encoding") != encoding || res.ContentLength != -1 || !res.Close || string(body) != base64.StdEncoding.EncodeToString(large) {
+			t.Fatalf("%s large: Content-Length %d close %v %d bytes", encoding, res.ContentLength, res.Close, len(body))
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	config := testConfig()
+	config.ETag = true
+	engine := testEngine(config, stringHandler(testBody))
+	etags := map[string]string{}
+	for _, encoding := range []string{"gzip", "br"} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", encoding), []byte(testBody))
+		etag := recorder.Header().Get("ETag")
+		if !strings.HasPrefix(etag, `W/"`) || !strings.HasSuffix(etag, "-"+encoding+`"`) {
+			t.Fatalf("%s: ETag = %q", encoding, etag)
+		}
+		etags[encoding] = etag
+	}
+	if etags["gzip"] == etags["br"] {
+		t.Fatalf("same ETag %q for both encodings", etags["gzip"])
+	}
+
+	for name, test := range map[string]struct {
+		encoding    string
+		ifNoneMatch string
+		status      int
+	}{
+		"match":          {"br", etags["br"], http.StatusNotModified},
+		"match in list":  {"gzip", `"x", ` + etags["gzip"], http.StatusNotModified},
+		"strong":         {"br", strings.TrimPrefix(etags["br"], "W/"), http.StatusNotModified},
+		"star":           {"br", "*", http.StatusNotModified},
+		"other encoding": {"br", etags["gzip"], http.StatusOK},
+		"mismatch":       {"gzip", `W/"x"`, http.StatusOK},
+	} {
+		req := testRequest("GET", "/", test.encoding)
+		req.Header.Set("If-None-Match", test.ifNoneMatch)
+		if test.status == http.StatusOK {
+			recorder := compresstest.AssertRoundTrip(t, engine, req, []byte(testBody))
+			if recorder.Code != test.status || recorder.Header().Get("ETag") != etags[test.encoding] {
+				t.Fatalf("%s: got %d %v", name, recorder.Code, recorder.Header())
+			}
+			continue
+		}
+		// 304 没有内容 不能解码
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, req)
+		header := recorder.Header()
+		if recorder.Code != test.status || header.Get("ETag") != etags[test.encoding] || header.Get("Content-Encoding") != test.encoding {
+			t.Fatalf("%s: got %d %v", name, recorder.Code, header)
+		}
+		if recorder.Body.Len() != 0 || header.Get("Content-Length") != "" {
+			t.Fatalf("%s: %d bytes %v", name, recorder.Body.Len(), header)
+		}
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	for name, change := range map[string]func(config *Config){
+		"default":               func(config *Config) {},
+		"always content length": func(config *Config) { config.AlwaysContentLength = true },
+		"debug":                 func(config *Config) { config.Debug = true },
+	} {
+		config := testConfig()
+		change(&config)
+		engine := testEngine(config, func(ctx *gin.Context) {
+			ctx.Header("Content-Type", "text/plain")
+			ctx.Header("Trailer", "X-Checksum")
+			for i := 0; i < 5; i++ {
+				ctx.Writer.WriteString(testBody)
+				if ctx.Query("flush") != "" {
+					ctx.Writer.Flush()
+				}
+			}
+			// 结束后设置 trailer 的值, 不经过压缩器
+			ctx.Writer.Header().Set("X-Checksum", "sum")
+			ctx.Writer.Header().Set(http.TrailerPrefix+"X-Extra", "extra")
+		})
+		for _, target := range []string{"/", "/?flush=1"} {
+			for _, encoding := range []string{"gzip", "br"} {
+				res, reader := serveStream(t, engine, target, encoding)
+				body, err := ioutil.ReadAll(reader)
+				if err != nil || string(body) != strings.Repeat(testBody, 5) {
+					t.Fatalf("%s %s %s: %d bytes %v", name, target, encoding, len(body), err)
+				}
+				if res.Header.Get("Content-Encoding") != encoding || len(res.TransferEncoding) == 0 {
+					t.Fatalf("%s %s %s: Content-Encoding %q Transfer-Encoding %v", name, target, encoding, res.Header.Get("Content-Encoding"), res.TransferEncoding)
+				}
+				if res.Trailer.Get("X-Checksum") != "sum" || res.Trailer.Get("X-Extra") != "extra" {
+					t.Fatalf("%s %s %s: trailer = %v", name, target, encoding, res.Trailer)
+				}
+			}
+		}
+	}
+}
+
+func TestChunked(t *testing.T) {
+	random := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(random)
+	large := base64.StdEncoding.EncodeToString(random)
+	engine := testEngine(testConfig(), func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/plain")
+		if val := ctx.Query("te"); val != "" {
+			ctx.Header("Transfer-Encoding", val)
+		}
+		switch ctx.Query("body") {
+		case "small":
+			ctx.Writer.WriteString(testBody)
+		case "flush":
+			ctx.Writer.WriteString(testBody)
+			ctx.Writer.Flush()
+			ctx.Writer.WriteString(testBody)
+		default:
+			ctx.Writer.WriteString(large)
+		}
+	})
+	for target, want := range map[string]string{
+		"/":                   large,
+		"/?body=flush":        testBody + testBody,
+		"/?te=identity":       large,
+		"/?body=flush&te=foo": testBody + testBody,
+	} {
+		for _, encoding := range []string{"gzip", "br"} {
+			res, reader := serveStream(t, engine, target, encoding)
+			body, err := ioutil.ReadAll(reader)
+			if err != nil || string(body) != want {
+				t.Fatalf("%s %s: %d bytes %v", target, encoding, len(body), err)
+			}
+			if res.Header.Get("Content-Encoding") != encoding || !reflect.DeepEqual(res.TransferEncoding, []string{"chunked"}) || res.Close {
+				t.Fatalf("%s %s: Transfer-Encoding %v close %v header %v", target, encoding, res.TransferEncoding, res.Close, res.Header)
+			}
+		}
+	}
+
+	// 处理函数结束时还没发送的小响应由 net/http 设置 Content-Length
+	res, reader := serveStream(t, engine, "/?body=small", "gzip")
+	if body, err := ioutil.ReadAll(reader); err != nil || string(body) != testBody {
+		t.Fatalf("small: %d bytes %v", len(body), err)
+	}
+	if res.ContentLength <= 0 || len(res.TransferEncoding) != 0 {
+		t.Fatalf("small: Content-Length %d Transfer-Encoding %v", res.ContentLength, res.TransferEncoding)
+	}
+}
+
+func TestAlwaysContentLength(t *testing.T) {
+	config := testConfig()
+	config.AlwaysContentLength = true
+	config.MaxBufferBytes = 4096
+	large := strings.Repeat(testBody, 10)
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/plain")
+		switch ctx.Query("size") {
+		case "large":
+			// 随机内容压缩后超过 MaxBufferBytes
+			random := make([]byte, 8192)
+			rand.New(rand.NewSource(1)).Read(random)
+			ctx.Writer.WriteString(base64.StdEncoding.EncodeToString(random))
+		default:
+			for i := 0; i < 10; i++ {
+				ctx.Writer.WriteString(testBody)
+			}
+		}
+	})
+
+	for _, encoding := range []string{"gzip", "br"} {
+		res, reader := serveStream(t, engine, "/", encoding)
+		body, err := ioutil.ReadAll(reader)
+		if err != nil || string(body) != large {
+			t.Fatalf("%s: %d bytes %v", encoding, len(body), err)
+		}
+		if res.Header.Get("Content-Encoding") != encoding || res.ContentLength <= 0 || len(res.TransferEncoding) != 0 {
+			t.Fatalf("%s: Content-Length %d Transfer-Encoding %v", encoding, res.ContentLength, res.TransferEncoding)
+		}
+
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", encoding), []byte(large))
+		if val := recorder.Header().Get("Content-Length"); val != strconv.Itoa(recorder.Body.Len()) {
+			t.Fatalf("%s: Content-Length = %q, want %d", encoding, val, recorder.Body.Len())
+		}
+
+		// 超过 MaxBufferBytes 改为 chunked
+		res, reader = serveStream(t, engine, "/?size=large", encoding)
+		if _, err := ioutil.ReadAll(reader); err != nil {
+			t.Fatal(err)
+		}
+		if res.Header.Get("Content-Encoding") != encoding || res.ContentLength != -1 || len(res.TransferEncoding) == 0 {
+			t.Fatalf("%s large: Content-Length %d Transfer-Encoding %v", encoding, res.ContentLength, res.TransferEncoding)
+		}
+	}
+}
+
+func TestBreachMitigation(t *testing.T) {
+	for _, mitigation := range []bool{false, true} {
+		var stats CompressStats
+		config := testConfig()
+		config.BreachMitigation = mitigation
+		config.OnComplete = func(val CompressStats) {
+			stats = val
+		}
+		engine := testEngine(config, func(ctx *gin.Context) {
+			if val := ctx.Query("cookie"); val != "" {
+				ctx.Writer.Header().Add("Set-Cookie", "session=1; HttpOnly")
+				ctx.Writer.Header().Add("Set-Cookie", val+"=secret; Path=/")
+			}
+			ctx.String(http.StatusOK, testBody)
+		})
+		for cookie, breach := range map[string]bool{
+			"":           false,
+			"theme":      false,
+			"csrftoken":  true,
+			"XSRF-TOKEN": true,
+			"_csrf":      true,
+		} {
+			want := "gzip"
+			if mitigation && breach {
+				want = ""
+			}
+			recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/?cookie="+cookie, "gzip"), []byte(testBody))
+			if val := recorder.Header().Get("Content-Encoding"); val != want {
+				t.Fatalf("%v %q: Content-Encoding = %q, want %q", mitigation, cookie, val, want)
+			}
+			if want == "" && stats.SkipReason != SkipBreach {
+				t.Fatalf("stats = %+v", stats)
+			}
+		}
+	}
+}
+
+func TestShouldCompress(t *testing.T) {
+	var stats CompressStats
+	config := testConfig()
+	config.ShouldCompress = func(req *http.Request, header http.Header) bool {
+		return req.URL.Query().Get("secret") == "" && header.Get("X-Reflect") == ""
+	}
+	config.OnComplete = func(val CompressStats) {
+		stats = val
+	}
+	engine := testEngine(config, func(ctx *gin.Context) {
+		if ctx.Query("reflect") != "" {
+			ctx.Header("X-Reflect", "1")
+		}
+		ctx.String(http.StatusOK, testBody)
+	})
+	for target, want := range map[string]string{
+		"/":           "gzip",
+		"/?secret=1":  "",
+		"/?reflect=1": "",
+	} {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, "gzip"), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != want {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", target, val, want)
+		}
+		if want == "" && stats.SkipReason != SkipShouldCompress {
+			t.Fatalf("stats = %+v", stats)
+		}
+	}
+}
+
+func TestConcurrentSafe(t *testing.T) {
+	config := testConfig()
+	config.ConcurrentSafe = true
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/plain")
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					fmt.Fprintf(ctx.Writer, "goroutine %d line %d\n", i, j)
+					if j%10 == 0 {
+						ctx.Writer.Flush()
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	for _, encoding := range []string{"gzip", "br"} {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, testRequest("GET", "/", encoding))
+		body, err := compresstest.Decode(recorder.Header().Get("Content-Encoding"), recorder.Body.Bytes())
+		if err != nil || recorder.Header().Get("Content-Encoding") != encoding {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		// 每行完整 顺序不确定
+		lines := map[string]bool{}
+		for _, line := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+			lines[line] = true
+		}
+		for i := 0; i < 8; i++ {
+			for j := 0; j < 100; j++ {
+				if line := fmt.Sprintf("goroutine %d line %d", i, j); !lines[line] {
+					t.Fatalf("%s: missing %q", encoding, line)
+				}
+			}
+		}
+		if len(lines) != 800 {
+			t.Fatalf("%s: %d lines, want 800", encoding, len(lines))
+		}
+	}
+}
+
+func TestVaryOnlyWhenCompressed(t *testing.T) {
+	config := testConfig()
+	config.VaryOnlyWhenCompressed = true
+	engine := testEngine(config, func(ctx *gin.Context) {
+		if ctx.Query("vary") != "" {
+			ctx.Header("Vary", "Origin")
+		}
+		switch ctx.Query("type") {
+		case "png":
+			ctx.Data(http.StatusOK, "image/png", []byte(testBody))
+		case "empty":
+			ctx.Header("Content-Length", "100")
+			ctx.Data(http.StatusOK, "text/plain", nil)
+		default:
+			ctx.String(http.StatusOK, testBody)
+		}
+	})
+	for _, test := range []struct {
+		method string
+		target string
+		body   string
+		want   string
+	}{
+		{"GET", "/", testBody, "Accept-Encoding"},
+		{"HEAD", "/", testBody, "Accept-Encoding"},
+		{"GET", "/?vary=1", testBody, "Origin, Accept-Encoding"},
+		{"GET", "/?type=png", testBody, ""},
+		{"GET", "/?type=png&vary=1", testBody, "Origin"},
+		{"GET", "/?type=empty", "", ""},
+		{"GET", "/?type=empty&vary=1", "", "Origin"},
+	} {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, testRequest(test.method, test.target, "gzip"))
+		if val := recorder.Header().Get("Vary"); val != test.want {
+			t.Fatalf("%s %s: Vary = %q, want %q", test.method, test.target, val, test.want)
+		}
+		if test.method == "GET" {
+			compresstest.AssertRoundTrip(t, engine, testRequest(test.method, test.target, "gzip"), []byte(test.body))
+		}
+	}
+
+	// 客户端不支持压缩时同样没有 Vary
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", ""), []byte(testBody))
+	if val := recorder.Header().Get("Vary"); val != "" {
+		t.Fatalf("Vary = %q, want none", val)
+	}
+}
+
+type closeRecorder struct {
+	io.WriteCloser
+	closed *int
+}
+
+func (w closeRecorder) Close() error {
+	*w.closed++
+	return w.WriteCloser.Close()
+}
+
+func TestBrotliWriterFactory(t *testing.T) {
+	var calls, closed, quality, lgwin int
+	config := testConfig()
+	config.BrQuality = 7
+	config.BrLGWin = 20
+	config.BrotliWriterFactory = func(w io.Writer, q, l int) io.WriteCloser {
+		calls++
+		quality, lgwin = q, l
+		return closeRecorder{cbrotli.NewWriter(w, cbrotli.WriterOptions{Quality: q, LGWin: l}), &closed}
+	}
+	engine := testEngine(config, stringHandler(testBody))
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "br"), []byte(testBody))
+	if recorder.Header().Get("Content-Encoding") != "br" || calls != 1 || closed != 1 || quality != 7 || lgwin != 20 {
+		t.Fatalf("calls %d closed %d quality %d lgwin %d header %v", calls, closed, quality, lgwin, recorder.Header())
+	}
+
+	// 返回 nil 按创建失败回退
+	config.BrotliWriterFactory = func(w io.Writer, quality, lgwin int) io.WriteCloser {
+		return nil
+	}
+	engine = testEngine(config, stringHandler(testBody))
+	recorder = compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "br, gzip"), []byte(testBody))
+	if val := recorder.Header().Get("Content-Encoding"); val != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", val)
+	}
+}
+
+func TestGzipWriterFactory(t *testing.T) {
+	var calls, closed, level int
+	config := testConfig()
+	config.GzipLevel = 6
+	config.GzipWriterFactory = func(w io.Writer, l int) (io.WriteCloser, error) {
+		calls++
+		level = l
+		writer, err := kgzip.NewWriterLevel(w, l)
+		return closeRecorder{writer, &closed}, err
+	}
+	engine := testEngine(config, stringHandler(testBody))
+	for i := 1; i <= 2; i++ {
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+		if recorder.Header().Get("Content-Encoding") != "gzip" || calls != i || closed != i || level != 6 {
+			t.Fatalf("calls %d closed %d level %d header %v", calls, closed, level, recorder.Header())
+		}
+	}
+
+	// 出错时不压缩
+	config.GzipWriterFactory = func(w io.Writer, level int) (io.WriteCloser, error) {
+		return nil, errors.New("factory")
+	}
+	var stats CompressStats
+	config.OnComplete = func(s CompressStats) { stats = s }
+	engine = testEngine(config, stringHandler(testBody))
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	if val := recorder.Header().Get("Content-Encoding"); val != "" || stats.SkipReason != SkipCodecError {
+		t.Fatalf("Content-Encoding = %q, reason %q", val, stats.SkipReason)
+	}
+}
@@ -0,0 +1,59 @@
+package compresstest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/brotli/go/cbrotli"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 按 Content-Encoding 解码响应内容
+func Decode(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	case "br":
+		return cbrotli.Decode(body)
+	case "zstd":
+		reader, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return reader.DecodeAll(body, nil)
+	case "x-snappy-framed":
+		return ioutil.ReadAll(snappy.NewReader(bytes.NewReader(body)))
+	}
+	return nil, fmt.Errorf("compresstest: unknown encoding %q", encoding)
+}
+
+// 请求 handler 断言解码后的内容和处理函数写入的 want 完全一致
+func AssertRoundTrip(t testing.TB, handler http.Handler, req *http.Request, want []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	encoding := recorder.Header().Get("Content-Encoding")
+	body, err := Decode(encoding, recorder.Body.Bytes())
+	if err != nil {
+		t.Fatalf("compresstest: decode %q: %v", encoding, err)
+	}
+	if !bytes.Equal(body, want) {
+		t.Fatalf("compresstest: %q body mismatch: got %d bytes, want %d bytes", encoding, len(body), len(want))
+	}
+	return recorder
+}
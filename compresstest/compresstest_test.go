@@ -0,0 +1,127 @@
+package compresstest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/brotli/go/cbrotli"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+var testBody = []byte(strings.Repeat("hello world ", 200))
+
+func encode(t *testing.T, encoding string, body []byte) []byte {
+	var buf bytes.Buffer
+	switch encoding {
+	case "", "identity":
+		return body
+	case "gzip":
+		writer := gzip.NewWriter(&buf)
+		writer.Write(body)
+		writer.Close()
+	case "br":
+		data, err := cbrotli.Encode(body, cbrotli.WriterOptions{Quality: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	case "zstd":
+		writer, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write(body)
+		writer.Close()
+	case "x-snappy-framed":
+		writer := snappy.NewBufferedWriter(&buf)
+		writer.Write(body)
+		writer.Close()
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	for _, encoding := range []string{"", "identity", "gzip", "br", "zstd", "x-snappy-framed"} {
+		body, err := Decode(encoding, encode(t, encoding, testBody))
+		if err != nil || !bytes.Equal(body, testBody) {
+			t.Fatalf("%q: %d bytes %v", encoding, len(body), err)
+		}
+	}
+	if _, err := Decode("deflate", testBody); err == nil {
+		t.Fatal("deflate: want error")
+	}
+	if _, err := Decode("gzip", testBody); err == nil {
+		t.Fatal("invalid gzip: want error")
+	}
+}
+
+func TestAssertRoundTrip(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encoding := req.Header.Get("Accept-Encoding")
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Write(encode(t, encoding, testBody))
+	})
+	for _, encoding := range []string{"", "gzip", "br", "zstd", "x-snappy-framed"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		recorder := AssertRoundTrip(t, handler, req, testBody)
+		if val := recorder.Header().Get("Content-Encoding"); val != encoding {
+			t.Fatalf("Content-Encoding = %q, want %q", val, encoding)
+		}
+	}
+}
+
+// 记录失败 和 t.Fatalf 一样结束当前 goroutine
+type fatalRecorder struct {
+	testing.TB
+	failed bool
+}
+
+func (t *fatalRecorder) Fatalf(format string, args ...interface{}) {
+	t.failed = true
+	runtime.Goexit()
+}
+
+func sseHandler(flush bool) func(next <-chan struct{}) http.Handler {
+	return func(next <-chan struct{}) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := 0; i < 3; i++ {
+				<-next
+				fmt.Fprintf(w, "event:msg\ndata:n%d\n\n", i)
+				if flush {
+					w.(http.Flusher).Flush()
+				}
+			}
+		})
+	}
+}
+
+func TestAssertSSELatency(t *testing.T) {
+	timing := AssertSSELatency(t, sseHandler(true), "", 3, time.Second)
+	if len(timing.Latency) != 3 || timing.Events[2] != "event:msg\ndata:n2" || timing.FirstByte <= 0 {
+		t.Fatalf("timing %+v", timing)
+	}
+
+	// 没有刷新时事件在 bound 之后失败 不会一直阻塞
+	recorder := &fatalRecorder{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		AssertSSELatency(recorder, sseHandler(false), "", 3, 100*time.Millisecond)
+	}()
+	<-done
+	if !recorder.failed {
+		t.Fatal("buffered events not reported")
+	}
+}
@@ -0,0 +1,166 @@
+package compresstest
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/brotli/go/cbrotli"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// SSE 端点经过中间件后的延迟
+type SSETiming struct {
+	// 响应的 Content-Encoding
+	Encoding string
+	// 放行第一个事件到客户端解码出第一个事件, 包括建立连接和发送头
+	FirstByte time.Duration
+	// 每个事件从处理函数收到放行到客户端解码出来的时间
+	Latency []time.Duration
+	// 解码后的事件 不含结尾的空行
+	Events []string
+}
+
+type sseEvent struct {
+	data string
+	at   time.Time
+	err  error
+}
+
+// 启动真实的服务器请求 SSE 端点, 断言每个事件在处理函数刷新后 bound 内到达客户端
+// newHandler 返回的 handler 每从 next 收到一次值写入并刷新一个事件, 共 events 个; 结束后 next 会关闭
+// 压缩器缓存刷新的内容时事件等到响应结束才到达, 会在 bound 之后失败而不是一直阻塞
+func AssertSSELatency(t testing.TB, newHandler func(next <-chan struct{}) http.Handler, acceptEncoding string, events int, bound time.Duration) SSETiming {
+	t.Helper()
+	next := make(chan struct{})
+	server := httptest.NewServer(newHandler(next))
+	// 先放行阻塞的处理函数 再等待服务器关闭
+	defer server.Close()
+	defer close(next)
+	done := make(chan struct{})
+	defer close(done)
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	type result struct {
+		res *http.Response
+		err error
+	}
+	results := make(chan result, 1)
+	start := time.Now()
+	// 头在第一次刷新时才发送 需要边请求边放行第一个事件
+	go func() {
+		res, err := http.DefaultTransport.RoundTrip(req)
+		results <- result{res, err}
+	}()
+
+	var timing SSETiming
+	var res *http.Response
+	var received <-chan sseEvent
+	for i := 0; i < events; i++ {
+		select {
+		case next <- struct{}{}:
+		case <-time.After(bound):
+			t.Fatalf("compresstest: handler did not wait for event %d", i)
+		}
+		released := time.Now()
+		if res == nil {
+			select {
+			case r := <-results:
+				if r.err != nil {
+					t.Fatalf("compresstest: request: %v", r.err)
+				}
+				res = r.res
+				defer res.Body.Close()
+				timing.Encoding = res.Header.Get("Content-Encoding")
+			case <-time.After(bound):
+				t.Fatalf("compresstest: no response header within %s", bound)
+			}
+			received = readEvents(res, done)
+		}
+		select {
+		case event := <-received:
+			if event.err != nil {
+				t.Fatalf("compresstest: %q event %d: %v", timing.Encoding, i, event.err)
+			}
+			if i == 0 {
+				timing.FirstByte = event.at.Sub(start)
+			}
+			timing.Latency = append(timing.Latency, event.at.Sub(released))
+			timing.Events = append(timing.Events, event.data)
+		case <-time.After(bound):
+			t.Fatalf("compresstest: %q event %d not received within %s", timing.Encoding, i, bound)
+		}
+	}
+	return timing
+}
+
+// 按 Content-Encoding 流式解码 逐个发送以空行结尾的事件, done 关闭后退出
+func readEvents(res *http.Response, done <-chan struct{}) <-chan sseEvent {
+	events := make(chan sseEvent)
+	go func() {
+		send := func(event sseEvent) bool {
+			select {
+			case events <- event:
+				return true
+			case <-done:
+				return false
+			}
+		}
+		body, err := newReader(res.Header.Get("Content-Encoding"), res.Body)
+		if err != nil {
+			send(sseEvent{err: err})
+			return
+		}
+		reader := bufio.NewReader(body)
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				send(sseEvent{err: err})
+				return
+			}
+			if line = strings.TrimRight(line, "\r\n"); line != "" {
+				lines = append(lines, line)
+				continue
+			}
+			if len(lines) != 0 {
+				if !send(sseEvent{data: strings.Join(lines, "\n"), at: time.Now()}) {
+					return
+				}
+				lines = nil
+			}
+		}
+	}()
+	return events
+}
+
+func newReader(encoding string, body io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		return gzip.NewReader(body)
+	case "br":
+		return cbrotli.NewReader(body), nil
+	case "zstd":
+		reader, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return reader.IOReadCloser(), nil
+	case "x-snappy-framed":
+		return snappy.NewReader(body), nil
+	}
+	return nil, fmt.Errorf("compresstest: unknown encoding %q", encoding)
+}
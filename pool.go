@@ -0,0 +1,44 @@
+package compress
+
+import (
+	"sync"
+)
+
+// 压缩器的池 max 大于 0 时使用固定容量的 channel, 最多保留 max 个, 放回时已满直接丢弃
+// channel 中的 writer 不会像 sync.Pool 一样在 GC 时回收
+type writerPool struct {
+	sync.Pool
+	items chan interface{}
+}
+
+func newWriterPool(max int, fn func() interface{}) *writerPool {
+	pool := &writerPool{}
+	pool.New = fn
+	if max > 0 {
+		pool.items = make(chan interface{}, max)
+	}
+	return pool
+}
+
+func (p *writerPool) Get() interface{} {
+	if p.items == nil {
+		return p.Pool.Get()
+	}
+	select {
+	case item := <-p.items:
+		return item
+	default:
+		return p.New()
+	}
+}
+
+func (p *writerPool) Put(item interface{}) {
+	if p.items == nil {
+		p.Pool.Put(item)
+		return
+	}
+	select {
+	case p.items <- item:
+	default:
+	}
+}
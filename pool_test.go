@@ -0,0 +1,113 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/brotli/go/cbrotli"
+
+	"github.com/otamoe/gin-compress/compresstest"
+)
+
+func TestMaxPooledWriters(t *testing.T) {
+	config := testConfig()
+	config.EnableZstd = true
+	config.MaxPooledWriters = 2
+	config.PrewarmPool = 5
+	c := newCompressor(config)
+	gzipPool, zstdPool := c.gzipPool(config.GzipLevel), c.zstdPool(config.ZstdLevel)
+	if len(gzipPool.items) != 2 || len(zstdPool.items) != 2 {
+		t.Fatalf("prewarm: gzip %d zstd %d", len(gzipPool.items), len(zstdPool.items))
+	}
+
+	// 同时进行的压缩都在持有 writer 时才放行, 结束后池中最多保留 2 个
+	const n = 10
+	var written, done sync.WaitGroup
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writer, finish, _ := c.newWriter(w, req)
+		defer finish()
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.Write([]byte(testBody))
+		written.Done()
+		<-release
+	})
+	for _, encoding := range []string{"gzip", "zstd"} {
+		written.Add(n)
+		done.Add(n)
+		for i := 0; i < n; i++ {
+			go func() {
+				defer done.Done()
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, testRequest("GET", "/", encoding))
+				if val := recorder.Header().Get("Content-Encoding"); val != encoding {
+					t.Errorf("Content-Encoding = %q, want %s", val, encoding)
+				}
+			}()
+		}
+		written.Wait()
+		close(release)
+		done.Wait()
+		release = make(chan struct{})
+	}
+	if len(gzipPool.items) != 2 || len(zstdPool.items) != 2 {
+		t.Fatalf("pooled: gzip %d zstd %d", len(gzipPool.items), len(zstdPool.items))
+	}
+}
+
+// 每种编码结束后都关闭压缩器 (输出完整可解码) 并放回对应的池
+func TestCodecReleased(t *testing.T) {
+	config := testConfig()
+	config.EnableZstd = true
+	config.EnableSnappy = true
+	config.MaxPooledWriters = 4
+	c := newCompressor(config)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writer, finish, _ := c.newWriter(w, req)
+		defer finish()
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.Write([]byte(testBody))
+	})
+	pools := map[string]*writerPool{
+		"gzip":            c.gzipPool(config.GzipLevel),
+		"zstd":            c.zstdPool(config.ZstdLevel),
+		"x-snappy-framed": c.snappyPool,
+	}
+	for _, encoding := range []string{"gzip", "br", "zstd", "x-snappy-framed"} {
+		for i := 0; i < 2; i++ {
+			recorder := compresstest.AssertRoundTrip(t, handler, testRequest("GET", "/", encoding), []byte(testBody))
+			if val := recorder.Header().Get("Content-Encoding"); val != encoding {
+				t.Fatalf("Content-Encoding = %q, want %s", val, encoding)
+			}
+		}
+		// 同一个 writer 放回后复用
+		if pool, ok := pools[encoding]; ok && len(pool.items) != 1 {
+			t.Fatalf("%s: %d pooled", encoding, len(pool.items))
+		}
+		if val := atomic.LoadInt64(&c.brotli); val != 0 {
+			t.Fatalf("%s: %d active brotli", encoding, val)
+		}
+	}
+
+	// 工厂创建的 writer 关闭但不放回池
+	var closed int
+	config.BrotliWriterFactory = func(w io.Writer, quality, lgwin int) io.WriteCloser {
+		return closeRecorder{cbrotli.NewWriter(w, cbrotli.WriterOptions{Quality: quality, LGWin: lgwin}), &closed}
+	}
+	config.GzipWriterFactory = func(w io.Writer, level int) (io.WriteCloser, error) {
+		writer, err := gzip.NewWriterLevel(w, level)
+		return closeRecorder{writer, &closed}, err
+	}
+	c = newCompressor(config)
+	for _, encoding := range []string{"gzip", "br"} {
+		compresstest.AssertRoundTrip(t, handler, testRequest("GET", "/", encoding), []byte(testBody))
+	}
+	if closed != 2 || len(c.gzipPool(config.GzipLevel).items) != 0 {
+		t.Fatalf("closed %d pooled %d", closed, len(c.gzipPool(config.GzipLevel).items))
+	}
+}
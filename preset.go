@@ -0,0 +1,82 @@
+package compress
+
+import (
+	"compress/gzip"
+	"strings"
+)
+
+// 默认压缩的文本类型
+var DefaultTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/xml",
+	"text/javascript",
+	"text/event-stream",
+	"application/javascript",
+	"application/json",
+	"application/x-ndjson",
+	"application/ld+json",
+	"application/manifest+json",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+}
+
+// Types 为 "*" 时不压缩的已压缩类型, "/*" 结尾的匹配整个主类型; +xml +json 结尾的 (image/svg+xml 等) 始终可压缩
+var IncompressibleTypes = []string{
+	"image/*",
+	"video/*",
+	"audio/*",
+	"font/woff",
+	"font/woff2",
+	"application/octet-stream",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+	"application/pdf",
+}
+
+func incompressible(mediatype string) bool {
+	if strings.HasSuffix(mediatype, "+xml") || strings.HasSuffix(mediatype, "+json") {
+		return false
+	}
+	for _, typ := range IncompressibleTypes {
+		if typ == mediatype || strings.HasSuffix(typ, "/*") && strings.HasPrefix(mediatype, typ[:len(typ)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// 速度优先 适合动态内容
+func PresetFast() Config {
+	return preset(gzip.BestSpeed, 1, 18, 1)
+}
+
+// 速度和压缩率平衡
+func PresetBalanced() Config {
+	return preset(6, 5, 22, 3)
+}
+
+// 压缩率优先 适合可缓存的静态内容
+func PresetBest() Config {
+	return preset(gzip.BestCompression, 11, 24, 19)
+}
+
+func preset(gzipLevel, brQuality, brLGWin, zstdLevel int) Config {
+	return Config{
+		Types:     append([]string(nil), DefaultTypes...),
+		MinLength: 1024,
+		BrQuality: brQuality,
+		BrLGWin:   brLGWin,
+		GzipLevel: gzipLevel,
+		ZstdLevel: zstdLevel,
+	}
+}
@@ -0,0 +1,34 @@
+package compress
+
+import (
+	"testing"
+
+	"github.com/otamoe/gin-compress/compresstest"
+)
+
+func TestPresets(t *testing.T) {
+	for name, config := range map[string]Config{
+		"fast":     PresetFast(),
+		"balanced": PresetBalanced(),
+		"best":     PresetBest(),
+	} {
+		if err := config.Validate(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		config.EnableZstd = true
+		engine := testEngine(config, stringHandler(testBody))
+		for _, encoding := range []string{"br", "gzip", "zstd"} {
+			recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", encoding), []byte(testBody))
+			if val := recorder.Header().Get("Content-Encoding"); val != encoding {
+				t.Fatalf("%s: Content-Encoding = %q, want %s", name, val, encoding)
+			}
+		}
+	}
+
+	// 预设返回副本 修改不影响 DefaultTypes
+	config := PresetFast()
+	config.Types[0] = "application/octet-stream"
+	if DefaultTypes[0] == "application/octet-stream" {
+		t.Fatal("preset shares DefaultTypes")
+	}
+}
@@ -0,0 +1,110 @@
+package compress
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+)
+
+const noWritten = -1
+
+// 标准库 http.ResponseWriter 适配为 gin.ResponseWriter 行为和 gin 内部的 responseWriter 一致
+type responseWriter struct {
+	http.ResponseWriter
+	size   int
+	status int
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	// 1xx 直接发送 不影响最终状态码
+	if informational(code) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if code > 0 && w.status != code {
+		w.status = code
+	}
+}
+
+func (w *responseWriter) WriteHeaderNow() {
+	if !w.Written() {
+		w.size = 0
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *responseWriter) Write(data []byte) (n int, err error) {
+	w.WriteHeaderNow()
+	n, err = w.ResponseWriter.Write(data)
+	w.size += n
+	return
+}
+
+func (w *responseWriter) WriteString(s string) (n int, err error) {
+	w.WriteHeaderNow()
+	n, err = io.WriteString(w.ResponseWriter, s)
+	w.size += n
+	return
+}
+
+func (w *responseWriter) Status() int {
+	return w.status
+}
+
+func (w *responseWriter) Size() int {
+	return w.size
+}
+
+func (w *responseWriter) Written() bool {
+	return w.size != noWritten
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.size < 0 {
+		w.size = 0
+	}
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (w *responseWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (w *responseWriter) Flush() {
+	w.WriteHeaderNow()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseWriter) Pusher() http.Pusher {
+	if pusher, ok := w.ResponseWriter.(http.Pusher); ok {
+		return pusher
+	}
+	return nil
+}
+
+// http.ResponseController 通过 Unwrap 找到支持 SetWriteDeadline 等的底层 writer
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// 返回 gin.ResponseWriter 内部的 http.ResponseWriter
+// gin v1.3.0 的 writer 没有 Unwrap, 内嵌的字段是导出的 通过反射读取
+func unwrap(w http.ResponseWriter) http.ResponseWriter {
+	if writer, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+		return writer.Unwrap()
+	}
+	val := reflect.ValueOf(w)
+	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	field := val.Elem().FieldByName("ResponseWriter")
+	if !field.IsValid() || !field.CanInterface() {
+		return nil
+	}
+	writer, _ := field.Interface().(http.ResponseWriter)
+	return writer
+}
@@ -0,0 +1,114 @@
+package compress
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/otamoe/gin-compress/compresstest"
+)
+
+func TestNewWriter(t *testing.T) {
+	req := testRequest("GET", "/", "gzip")
+	recorder := httptest.NewRecorder()
+	writer, finish := NewWriter(recorder, req, testConfig())
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.Write([]byte(testBody))
+	finish()
+
+	body, err := compresstest.Decode(recorder.Header().Get("Content-Encoding"), recorder.Body.Bytes())
+	if err != nil || string(body) != testBody || recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got %q %v", recorder.Header().Get("Content-Encoding"), err)
+	}
+
+	// 没有写入时 finish 发送状态码
+	recorder = httptest.NewRecorder()
+	writer, finish = NewWriter(recorder, req, testConfig())
+	writer.WriteHeader(http.StatusNoContent)
+	finish()
+	if recorder.Code != http.StatusNoContent || recorder.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("got %d %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	handler := Handler(testConfig())(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(testBody))
+	}))
+	for _, encoding := range []string{"br", "gzip", ""} {
+		recorder := compresstest.AssertRoundTrip(t, handler, testRequest("GET", "/", encoding), []byte(testBody))
+		if val := recorder.Header().Get("Content-Encoding"); val != encoding {
+			t.Fatalf("Content-Encoding = %q, want %q", val, encoding)
+		}
+	}
+}
+
+func TestResponseController(t *testing.T) {
+	var deadline, flush error
+	check := func(w http.ResponseWriter) {
+		controller := http.NewResponseController(w)
+		deadline = controller.SetWriteDeadline(time.Now().Add(time.Minute))
+		w.Write([]byte(testBody))
+		flush = controller.Flush()
+	}
+
+	engine := gin.New()
+	engine.Use(Compress(testConfig()))
+	engine.GET("/", func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/plain")
+		check(ctx.Writer)
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/", engine)
+	mux.Handle("/std", Handler(testConfig())(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		check(w)
+	})))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, target := range []string{"/", "/std"} {
+		deadline, flush = nil, nil
+		req, _ := http.NewRequest("GET", server.URL+target, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if deadline != nil || flush != nil {
+			t.Fatalf("%s: deadline %v flush %v", target, deadline, flush)
+		}
+		body, err := compresstest.Decode(res.Header.Get("Content-Encoding"), data)
+		if err != nil || string(body) != testBody || res.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("%s: %q %v", target, res.Header.Get("Content-Encoding"), err)
+		}
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	if val := unwrap(&responseWriter{ResponseWriter: recorder}); val != recorder {
+		t.Fatalf("unwrap responseWriter = %v", val)
+	}
+	if val := unwrap(recorder); val != nil {
+		t.Fatalf("unwrap recorder = %v, want nil", val)
+	}
+
+	// gin 的 writer 没有 Unwrap 通过反射读取
+	var got http.ResponseWriter
+	engine := gin.New()
+	engine.GET("/", func(ctx *gin.Context) {
+		got = unwrap(ctx.Writer)
+	})
+	engine.ServeHTTP(recorder, testRequest("GET", "/", ""))
+	if got != recorder {
+		t.Fatalf("unwrap gin writer = %v", got)
+	}
+}
@@ -0,0 +1,176 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type (
+	CompressStats struct {
+		Encoding        string
+		OriginalBytes   int64
+		CompressedBytes int64
+		DurationNanos   int64
+		Skipped         bool
+		SkipReason      SkipReason
+		Cached          bool
+		DryRun          bool
+	}
+	SkipReason  string
+	countWriter struct {
+		io.Writer
+		n int64
+	}
+
+	// Debug 或 AlwaysContentLength 时暂存压缩后的输出 结束时把大小写入头
+	// 超过 limit 或刷新后不再暂存, Debug 的大小改为通过 trailer 发送, 不再设置 Content-Length
+	holdWriter struct {
+		io.Writer
+		header  http.Header
+		limit   int64
+		buffer  bytes.Buffer
+		spilled bool
+		debug   bool
+		length  bool
+		// 不为空时按暂存的内容设置 ETag, 值为编码
+		etag        string
+		ifNoneMatch string
+	}
+)
+
+const (
+	SkipNoEncoding            SkipReason = "no encoding"
+	SkipDisabled              SkipReason = "disabled"
+	SkipUserAgent             SkipReason = "user agent"
+	SkipMethod                SkipReason = "method"
+	SkipExtension             SkipReason = "extension"
+	SkipIdentity              SkipReason = "identity"
+	SkipAlreadyEncoded        SkipReason = "already encoded"
+	SkipNoTransform           SkipReason = "no transform"
+	SkipCacheControl          SkipReason = "cache control"
+	SkipShouldCompress        SkipReason = "should compress"
+	SkipBreach                SkipReason = "breach"
+	SkipStatusNotCompressible SkipReason = "status not compressible"
+	SkipRange                 SkipReason = "range"
+	SkipUnknownLength         SkipReason = "unknown length"
+	SkipTooShort              SkipReason = "too short"
+	SkipMimeMismatch          SkipReason = "mime mismatch"
+	SkipEntropy               SkipReason = "entropy"
+	SkipHead                  SkipReason = "head"
+	SkipCodecError            SkipReason = "codec error"
+	SkipEmpty                 SkipReason = "empty"
+	SkipHeaderWritten         SkipReason = "header written"
+)
+
+// Compress 结束时保存 CompressStats 的 ctx key
+const StatsKey = "compress_stats"
+
+// 读取 Compress 保存的统计, 只有 Compress 返回之后才有
+// 注册在 Compress 之前 (外层) 的中间件在 ctx.Next() 之后, 以及 OnClose 中可以读取; 处理函数和内层中间件中还没有
+func Stats(ctx *gin.Context) (CompressStats, bool) {
+	value, ok := ctx.Get(StatsKey)
+	if !ok {
+		return CompressStats{}, false
+	}
+	stats, ok := value.(CompressStats)
+	return stats, ok
+}
+
+// 压缩率 压缩后 / 压缩前
+func (stats CompressStats) Ratio() float64 {
+	if stats.OriginalBytes == 0 {
+		return 0
+	}
+	return float64(stats.CompressedBytes) / float64(stats.OriginalBytes)
+}
+
+func (w *countWriter) Write(data []byte) (n int, err error) {
+	n, err = w.Writer.Write(data)
+	w.n += int64(n)
+	return
+}
+
+func (w *holdWriter) Write(data []byte) (int, error) {
+	if !w.spilled {
+		if int64(w.buffer.Len()+len(data)) <= w.limit {
+			return w.buffer.Write(data)
+		}
+		if err := w.spill(); err != nil {
+			return 0, err
+		}
+	}
+	return w.Writer.Write(data)
+}
+
+// 头发送之前声明 trailer 再写出暂存的内容
+func (w *holdWriter) spill() error {
+	if w.spilled {
+		return nil
+	}
+	w.spilled = true
+	if w.debug {
+		w.header.Add("Trailer", "X-Compress-Original-Size, X-Compress-Encoded-Size")
+	}
+	_, err := w.Writer.Write(w.buffer.Bytes())
+	w.buffer.Reset()
+	return err
+}
+
+// 返回 true 表示 If-None-Match 匹配 暂存的内容已经丢弃, 需要发送 304
+func (w *holdWriter) finish(originalSize, encodedSize int64) bool {
+	if w.debug {
+		w.header.Set("X-Compress-Original-Size", strconv.FormatInt(originalSize, 10))
+		w.header.Set("X-Compress-Encoded-Size", strconv.FormatInt(encodedSize, 10))
+	}
+	if !w.spilled {
+		if w.etag != "" && w.buffer.Len() != 0 {
+			hash := fnv.New64a()
+			hash.Write(w.buffer.Bytes())
+			etag := fmt.Sprintf(`W/"%016x-%s"`, hash.Sum64(), w.etag)
+			w.header.Set("ETag", etag)
+			if etagMatch(w.ifNoneMatch, etag) {
+				w.header.Del("Content-Length")
+				w.buffer.Reset()
+				return true
+			}
+		}
+		// 处理函数声明了 trailer 时需要 chunked 发送, 设置 Content-Length 后 HTTP/1.1 会丢弃 trailer
+		if w.length && !trailers(w.header) {
+			w.header.Set("Content-Length", strconv.Itoa(w.buffer.Len()))
+		}
+		w.Writer.Write(w.buffer.Bytes())
+		w.buffer.Reset()
+	}
+	return false
+}
+
+func trailers(header http.Header) bool {
+	if len(header["Trailer"]) != 0 {
+		return true
+	}
+	for key := range header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// If-None-Match 使用弱比较 * 匹配任何 ETag
+func etagMatch(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, val := range strings.Split(ifNoneMatch, ",") {
+		val = strings.TrimSpace(val)
+		if val == "*" || strings.TrimPrefix(val, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
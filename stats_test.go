@@ -0,0 +1,377 @@
+package compress
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/brotli/go/cbrotli"
+
+	"github.com/otamoe/gin-compress/compresstest"
+)
+
+func TestOnCompleteStats(t *testing.T) {
+	var stats CompressStats
+	config := testConfig()
+	config.OnComplete = func(val CompressStats) {
+		stats = val
+	}
+	engine := testEngine(config, stringHandler(testBody))
+
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	if stats.Encoding != "gzip" || stats.Skipped {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if stats.OriginalBytes != int64(len(testBody)) || stats.CompressedBytes != int64(recorder.Body.Len()) {
+		t.Fatalf("stats = %+v, want %d -> %d", stats, len(testBody), recorder.Body.Len())
+	}
+	if stats.DurationNanos <= 0 || stats.Ratio() <= 0 || stats.Ratio() >= 1 {
+		t.Fatalf("duration %d ratio %f", stats.DurationNanos, stats.Ratio())
+	}
+}
+
+func TestStatsInContext(t *testing.T) {
+	var stats CompressStats
+	var ok, inHandler, onClose bool
+	config := testConfig()
+	config.OnClose = func(ctx *gin.Context) {
+		_, onClose = Stats(ctx)
+	}
+	engine := gin.New()
+	// 外层中间件在 Compress 返回之后读取
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Next()
+		stats, ok = Stats(ctx)
+	}, Compress(config))
+	engine.GET("/", func(ctx *gin.Context) {
+		_, inHandler = Stats(ctx)
+		ctx.String(http.StatusOK, testBody)
+	})
+
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	if !ok || inHandler || !onClose || stats.Encoding != "gzip" || stats.CompressedBytes != int64(recorder.Body.Len()) {
+		t.Fatalf("ok %v handler %v close %v stats %+v", ok, inHandler, onClose, stats)
+	}
+
+	compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", ""), []byte(testBody))
+	if !ok || !stats.Skipped || stats.SkipReason != SkipNoEncoding {
+		t.Fatalf("ok %v stats %+v", ok, stats)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var stats CompressStats
+	config := testConfig()
+	config.OnComplete = func(val CompressStats) {
+		stats = val
+	}
+	handler := func(ctx *gin.Context) {
+		ctx.Header("Content-Length", strconv.Itoa(len(testBody)))
+		ctx.String(http.StatusOK, testBody)
+	}
+	for _, encoding := range []string{"gzip", "br"} {
+		recorder := compresstest.AssertRoundTrip(t, testEngine(config, handler), testRequest("GET", "/", encoding), []byte(testBody))
+		compressed := recorder.Body.Len()
+
+		dryRun := config
+		dryRun.DryRun = true
+		dryRun.Debug = true
+		recorder = compresstest.AssertRoundTrip(t, testEngine(dryRun, handler), testRequest("GET", "/", encoding), []byte(testBody))
+		header := recorder.Header()
+		if header.Get("Content-Encoding") != "" || header.Get("Vary") != "" || header.Get("Content-Length") != strconv.Itoa(len(testBody)) {
+			t.Fatalf("%s: header = %v", encoding, header)
+		}
+		if !strings.HasPrefix(header.Get("X-Compress-Dry-Run"), encoding+";") {
+			t.Fatalf("%s: X-Compress-Dry-Run = %q", encoding, header.Get("X-Compress-Dry-Run"))
+		}
+		// 和实际压缩的大小一致
+		if !stats.DryRun || stats.Skipped || stats.Encoding != encoding || stats.OriginalBytes != int64(len(testBody)) || stats.CompressedBytes != int64(compressed) {
+			t.Fatalf("%s: stats = %+v, want %d compressed bytes", encoding, stats, compressed)
+		}
+	}
+
+	// 流式响应原样逐条发送
+	streamConfig := config
+	streamConfig.DryRun = true
+	streamConfig.MinLength = 0
+	streamConfig.Types = DefaultTypes
+	completed := make(chan CompressStats, 1)
+	streamConfig.OnComplete = func(val CompressStats) {
+		completed <- val
+	}
+	timing := compresstest.AssertSSELatency(t, func(next <-chan struct{}) http.Handler {
+		return testEngine(streamConfig, func(ctx *gin.Context) {
+			for i := 0; i < 3; i++ {
+				<-next
+				ctx.SSEvent("msg", i)
+				ctx.Writer.Flush()
+			}
+		})
+	}, "br", 3, time.Second)
+	// 服务器关闭前处理函数已经结束
+	stats = <-completed
+	if timing.Encoding != "" || !stats.DryRun || stats.Encoding != "br" || stats.CompressedBytes == 0 {
+		t.Fatalf("%q stats = %+v", timing.Encoding, stats)
+	}
+
+	// 不压缩的响应同样跳过
+	config.DryRun = true
+	compresstest.AssertRoundTrip(t, testEngine(config, stringHandler("short")), testRequest("GET", "/", "gzip"), []byte("short"))
+	if !stats.Skipped || stats.SkipReason != SkipTooShort || stats.DryRun {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	encoded, err := cbrotli.Encode([]byte(testBody), cbrotli.WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want, test := range map[SkipReason]struct {
+		config         func(*Config)
+		acceptEncoding string
+		userAgent      string
+		handler        gin.HandlerFunc
+		body           string
+	}{
+		SkipNoEncoding: {acceptEncoding: "deflate", handler: stringHandler(testBody)},
+		SkipDisabled: {
+			config:         func(config *Config) { config.DisableBrotli = true },
+			acceptEncoding: "br",
+			handler:        stringHandler(testBody),
+		},
+		SkipUserAgent: {
+			config:    func(config *Config) { config.SkipUserAgents = []string{"curl"} },
+			userAgent: "curl/8.0",
+			handler:   stringHandler(testBody),
+		},
+		SkipIdentity: {handler: func(ctx *gin.Context) {
+			ctx.Header("Content-Encoding", "identity")
+			ctx.String(http.StatusOK, testBody)
+		}},
+		SkipAlreadyEncoded: {handler: func(ctx *gin.Context) {
+			ctx.Header("Content-Encoding", "br")
+			ctx.Data(http.StatusOK, "text/plain", encoded)
+		}},
+		SkipNoTransform: {handler: func(ctx *gin.Context) {
+			ctx.Header("Cache-Control", "no-transform")
+			ctx.String(http.StatusOK, testBody)
+		}},
+		SkipCacheControl: {
+			config: func(config *Config) { config.CacheControlPolicy = CacheControlPublic },
+			handler: func(ctx *gin.Context) {
+				ctx.Header("Cache-Control", "private")
+				ctx.String(http.StatusOK, testBody)
+			},
+		},
+		SkipStatusNotCompressible: {handler: func(ctx *gin.Context) {
+			ctx.String(http.StatusFound, testBody)
+		}},
+		SkipRange: {handler: func(ctx *gin.Context) {
+			ctx.Header("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(testBody)-1, len(testBody)*2))
+			ctx.String(http.StatusPartialContent, testBody)
+		}},
+		SkipUnknownLength: {handler: func(ctx *gin.Context) {
+			ctx.Header("Content-Length", "-1")
+			ctx.String(http.StatusOK, testBody)
+		}},
+		SkipTooShort:     {handler: stringHandler("hi"), body: "hi"},
+		SkipMimeMismatch: {handler: func(ctx *gin.Context) { ctx.Data(http.StatusOK, "image/png", []byte(testBody)) }},
+		SkipEmpty: {handler: func(ctx *gin.Context) {
+			ctx.Header("Content-Length", "100")
+			ctx.Data(http.StatusOK, "text/plain", nil)
+		}, body: "-"},
+		SkipExtension: {
+			config:  func(config *Config) { config.ExcludeExtensions = []string{".txt"} },
+			handler: stringHandler(testBody),
+		},
+	} {
+		var stats CompressStats
+		config := testConfig()
+		config.Debug = true
+		config.OnComplete = func(val CompressStats) {
+			stats = val
+		}
+		if test.config != nil {
+			test.config(&config)
+		}
+		engine := testEngine(config, test.handler)
+
+		acceptEncoding := test.acceptEncoding
+		if acceptEncoding == "" {
+			acceptEncoding = "gzip"
+		}
+		req := testRequest("GET", "/a.txt", acceptEncoding)
+		if test.userAgent != "" {
+			req.Header.Set("User-Agent", test.userAgent)
+		}
+		body := test.body
+		switch body {
+		case "":
+			body = testBody
+		case "-":
+			body = ""
+		}
+		recorder := compresstest.AssertRoundTrip(t, engine, req, []byte(body))
+		if !stats.Skipped || stats.SkipReason != want {
+			t.Fatalf("%s: stats = %+v", want, stats)
+		}
+		if val := recorder.Header().Get("X-Compress-Skip"); val != string(want) {
+			t.Fatalf("%s: X-Compress-Skip = %q", want, val)
+		}
+	}
+}
+
+func TestSkipReasonHead(t *testing.T) {
+	var stats CompressStats
+	config := testConfig()
+	config.OnComplete = func(val CompressStats) {
+		stats = val
+	}
+	engine := testEngine(config, stringHandler(testBody))
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, testRequest("HEAD", "/", "gzip"))
+	// HEAD 的头和 GET 一致
+	if stats.SkipReason != SkipHead || recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("stats = %+v header = %v", stats, recorder.Header())
+	}
+}
+
+func TestDebugSizes(t *testing.T) {
+	config := testConfig()
+	config.Debug = true
+	engine := testEngine(config, stringHandler(testBody))
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	header := recorder.Header()
+	if header.Get("X-Compress-Original-Size") != strconv.Itoa(len(testBody)) || header.Get("X-Compress-Encoded-Size") != strconv.Itoa(recorder.Body.Len()) {
+		t.Fatalf("header = %v", header)
+	}
+	if header.Get("Trailer") != "" {
+		t.Fatalf("Trailer = %q, want none", header.Get("Trailer"))
+	}
+
+	// 超过 MaxBufferBytes 改为 trailer
+	config.MaxBufferBytes = 16
+	engine = testEngine(config, stringHandler(testBody))
+	recorder = compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip"), []byte(testBody))
+	trailer := recorder.Result().Trailer
+	if trailer.Get("X-Compress-Original-Size") != strconv.Itoa(len(testBody)) || trailer.Get("X-Compress-Encoded-Size") != strconv.Itoa(recorder.Body.Len()) {
+		t.Fatalf("trailer = %v", trailer)
+	}
+}
+
+func TestDebugNegotiation(t *testing.T) {
+	config := testConfig()
+	config.Debug = true
+	config.EnableZstd = true
+	engine := testEngine(config, func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, ctx.DefaultQuery("body", testBody))
+	})
+	for _, test := range []struct {
+		acceptEncoding string
+		body           string
+		want           string
+	}{
+		{"br, gzip", "", "offered=br,gzip; chosen=br"},
+		{"gzip, zstd;q=0.5", "", "offered=gzip,zstd; chosen=gzip"},
+		{"gzip;q=0.5, zstd", "", "offered=gzip,zstd; chosen=zstd"},
+		{"gzip;q=0.5, x-gzip, br;q=0", "", "offered=gzip; chosen=gzip"},
+		{"deflate", "", "offered=deflate; chosen=identity"},
+		{"", "", "offered=; chosen=identity"},
+		{"br, gzip", "hi", "offered=br,gzip; chosen=identity"},
+	} {
+		body := test.body
+		if body == "" {
+			body = testBody
+		}
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/?body="+url.QueryEscape(body), test.acceptEncoding), []byte(body))
+		if val := recorder.Header().Get("X-Compress-Negotiation"); val != test.want {
+			t.Fatalf("%q: X-Compress-Negotiation = %q, want %q", test.acceptEncoding, val, test.want)
+		}
+	}
+
+	// 禁用的编码仍然列在 offered 中
+	config.DisableBrotli = true
+	engine = testEngine(config, stringHandler(testBody))
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "br, gzip"), []byte(testBody))
+	if val := recorder.Header().Get("X-Compress-Negotiation"); val != "offered=br,gzip; chosen=gzip" {
+		t.Fatalf("X-Compress-Negotiation = %q", val)
+	}
+}
+
+func TestDebugInfo(t *testing.T) {
+	for _, test := range []struct {
+		config         func(*Config)
+		acceptEncoding string
+		cache          string
+		body           string
+		want           string
+	}{
+		{acceptEncoding: "br", want: "br;q=5;lgwin=22"},
+		{acceptEncoding: "gzip", want: "gzip;level=6"},
+		{
+			config:         func(config *Config) { config.BrQuality, config.BrotliMaxQualityForDynamic = 11, 4 },
+			acceptEncoding: "br",
+			want:           "br;q=4;lgwin=22",
+		},
+		{
+			config:         func(config *Config) { config.BrQuality, config.BrotliMaxQualityForDynamic = 11, 4 },
+			acceptEncoding: "br",
+			cache:          "public, max-age=60",
+			want:           "br;q=11;lgwin=22",
+		},
+		{
+			config:         func(config *Config) { config.AdaptiveCodec, config.AdaptiveThreshold = true, 4096 },
+			acceptEncoding: "br, gzip",
+			want:           "gzip;level=6",
+		},
+		{
+			config:         func(config *Config) { config.EnableZstd, config.ZstdLevel = true, 3 },
+			acceptEncoding: "zstd",
+			want:           "zstd;level=3",
+		},
+		{acceptEncoding: "gzip", body: "-", want: ""},
+		{acceptEncoding: "gzip", body: "hi", want: ""},
+	} {
+		config := testConfig()
+		config.Debug = true
+		if test.config != nil {
+			test.config(&config)
+		}
+		engine := testEngine(config, func(ctx *gin.Context) {
+			if val := ctx.Query("cache"); val != "" {
+				ctx.Header("Cache-Control", val)
+			}
+			if ctx.Query("body") == "-" {
+				ctx.Header("Content-Length", "100")
+				ctx.Data(http.StatusOK, "text/plain", nil)
+				return
+			}
+			body := ctx.Query("body")
+			if body == "" {
+				body = testBody
+			}
+			// AdaptiveCodec 按声明的长度选择编码
+			ctx.Header("Content-Length", strconv.Itoa(len(body)))
+			ctx.String(http.StatusOK, body)
+		})
+		body := test.body
+		switch body {
+		case "":
+			body = testBody
+		case "-":
+			body = ""
+		}
+		target := "/?cache=" + url.QueryEscape(test.cache) + "&body=" + url.QueryEscape(test.body)
+		recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", target, test.acceptEncoding), []byte(body))
+		if val := recorder.Header().Get("X-Compress-Info"); val != test.want {
+			t.Fatalf("%s %s: X-Compress-Info = %q, want %q", target, test.acceptEncoding, val, test.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var errTranscodeTooLarge = errors.New("gin-compress: transcode: decoded body too large")
+
+// Transcode 时暂存 gzip 的内容 超过 TranscodeMaxBytes 放弃转码
+type transcodeBuffer struct {
+	bytes.Buffer
+	w *compressWriter
+}
+
+func (b *transcodeBuffer) Write(data []byte) (int, error) {
+	if int64(b.Len()+len(data)) > b.w.config.TranscodeMaxBytes {
+		if err := b.w.passthrough(); err != nil {
+			return 0, err
+		}
+		return b.w.writer.Write(data)
+	}
+	return b.Buffer.Write(data)
+}
+
+// 只转码幂等的 GET, 客户端优先 brotli 时才有意义
+func (w *compressWriter) transcodable(contentEncoding string) bool {
+	return w.config.Transcode && !w.config.DryRun &&
+		strings.EqualFold(strings.TrimSpace(contentEncoding), "gzip") &&
+		w.request.Method == http.MethodGet &&
+		w.encoding == "br"
+}
+
+// 放弃转码 原样输出暂存的 gzip 内容
+func (w *compressWriter) passthrough() error {
+	buffer := w.transcode
+	w.transcode = nil
+	w.skip(SkipAlreadyEncoded)
+	_, err := w.ResponseWriter.Write(buffer.Bytes())
+	return err
+}
+
+// 解码暂存的 gzip 内容 用 brotli 重新压缩
+func (w *compressWriter) finishTranscode() {
+	data, err := gunzip(w.transcode.Bytes(), w.config.MaxBufferBytes)
+	if err != nil {
+		w.logf("gin-compress: transcode: %v", err)
+	}
+	if err != nil || len(data) == 0 {
+		w.passthrough()
+		return
+	}
+
+	header := w.Header()
+	header.Del("Content-Encoding")
+	if !w.start() {
+		header.Set("Content-Encoding", "gzip")
+		w.passthrough()
+		return
+	}
+	w.transcode = nil
+	// 暂存时按 gzip 的长度计数
+	w.stats.OriginalBytes = 0
+	w.write(data)
+}
+
+func gunzip(data []byte, limit int64) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err = ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errTranscodeTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,111 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/otamoe/gin-compress/compresstest"
+)
+
+func gzipBytes(data string) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write([]byte(data))
+	writer.Close()
+	return buf.Bytes()
+}
+
+func TestTranscode(t *testing.T) {
+	html := "<!DOCTYPE html><html><body>" + testBody + "</body></html>"
+	encoded := gzipBytes(html)
+	config := testConfig()
+	config.Transcode = true
+	config.TranscodeMaxBytes = 1024
+	config.Methods = []string{"*"}
+	engine := testEngine(config, func(ctx *gin.Context) {
+		body := encoded
+		switch ctx.Query("body") {
+		case "large":
+			random := make([]byte, 4096)
+			rand.New(rand.NewSource(1)).Read(random)
+			body = gzipBytes(base64.StdEncoding.EncodeToString(random))
+		case "corrupt":
+			body = append([]byte(nil), encoded[:len(encoded)/2]...)
+		}
+		ctx.Header("Content-Encoding", "gzip")
+		ctx.Header("Content-Length", strconv.Itoa(len(body)))
+		ctx.Data(http.StatusOK, "text/html; charset=utf-8", body)
+	})
+
+	// brotli 优先的客户端转码
+	recorder := compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "gzip, br"), []byte(html))
+	if recorder.Header().Get("Content-Encoding") != "br" || recorder.Header().Get("Content-Length") != "" {
+		t.Fatalf("header = %v", recorder.Header())
+	}
+
+	for _, test := range []struct {
+		method         string
+		target         string
+		acceptEncoding string
+	}{
+		{"GET", "/", "gzip"},
+		{"POST", "/", "br"},
+		{"GET", "/?body=large", "br"},
+		{"GET", "/?body=corrupt", "br"},
+	} {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, testRequest(test.method, test.target, test.acceptEncoding))
+		if recorder.Header().Get("Content-Encoding") != "gzip" || recorder.Header().Get("Content-Length") != strconv.Itoa(recorder.Body.Len()) {
+			t.Fatalf("%s %s: header = %v", test.method, test.target, recorder.Header())
+		}
+		if test.target == "/" && !bytes.Equal(recorder.Body.Bytes(), encoded) {
+			t.Fatalf("%s %s: body changed", test.method, test.target)
+		}
+	}
+
+	// 默认不转码
+	engine = testEngine(testConfig(), func(ctx *gin.Context) {
+		ctx.Header("Content-Encoding", "gzip")
+		ctx.Data(http.StatusOK, "text/html", encoded)
+	})
+	recorder = compresstest.AssertRoundTrip(t, engine, testRequest("GET", "/", "br"), []byte(html))
+	if recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("header = %v", recorder.Header())
+	}
+}
+
+func TestTranscodeReverseProxy(t *testing.T) {
+	html := "<!DOCTYPE html><html><body>" + testBody + "</body></html>"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body := gzipBytes(html)
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	config := testConfig()
+	config.Transcode = true
+	engine := testEngine(config, gin.WrapH(proxy))
+	res, reader := serveStream(t, engine, "/", "br")
+	body := new(bytes.Buffer)
+	if _, err := body.ReadFrom(reader); err != nil || body.String() != html {
+		t.Fatalf("%d bytes %v", body.Len(), err)
+	}
+	if res.Header.Get("Content-Encoding") != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", res.Header.Get("Content-Encoding"))
+	}
+}
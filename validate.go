@@ -0,0 +1,77 @@
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 检查配置 Compress 创建时会调用, 配置错误直接 panic
+func (c Config) Validate() error {
+	if !validGzipLevel(c.GzipLevel) {
+		return fmt.Errorf("gin-compress: invalid gzip level %d", c.GzipLevel)
+	}
+	if c.BrQuality < 0 || c.BrQuality > 11 {
+		return fmt.Errorf("gin-compress: invalid brotli quality %d", c.BrQuality)
+	}
+	if c.BrotliMaxQualityForDynamic < 0 || c.BrotliMaxQualityForDynamic > 11 {
+		return fmt.Errorf("gin-compress: invalid brotli max quality for dynamic %d", c.BrotliMaxQualityForDynamic)
+	}
+	// 0 表示根据 quality 自动选择
+	if c.BrLGWin != 0 && (c.BrLGWin < 10 || c.BrLGWin > 24) {
+		return fmt.Errorf("gin-compress: invalid brotli lgwin %d", c.BrLGWin)
+	}
+	if c.ZstdLevel < 0 || c.ZstdLevel > 22 {
+		return fmt.Errorf("gin-compress: invalid zstd level %d", c.ZstdLevel)
+	}
+	if c.MinLength < 0 {
+		return fmt.Errorf("gin-compress: invalid min length %d", c.MinLength)
+	}
+	if c.MaxBufferBytes < 0 {
+		return fmt.Errorf("gin-compress: invalid max buffer bytes %d", c.MaxBufferBytes)
+	}
+	if c.TranscodeMaxBytes < 0 {
+		return fmt.Errorf("gin-compress: invalid transcode max bytes %d", c.TranscodeMaxBytes)
+	}
+	if c.AdaptiveThreshold < 0 {
+		return fmt.Errorf("gin-compress: invalid adaptive threshold %d", c.AdaptiveThreshold)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("gin-compress: invalid timeout %s", c.Timeout)
+	}
+	if c.PrewarmPool < 0 {
+		return fmt.Errorf("gin-compress: invalid prewarm pool %d", c.PrewarmPool)
+	}
+	if c.MaxPooledWriters < 0 {
+		return fmt.Errorf("gin-compress: invalid max pooled writers %d", c.MaxPooledWriters)
+	}
+	switch c.CacheControlPolicy {
+	case CacheControlAny, CacheControlPublic, CacheControlPrivate:
+	default:
+		return fmt.Errorf("gin-compress: invalid cache control policy %q", c.CacheControlPolicy)
+	}
+	for typ, codec := range c.CodecByType {
+		switch codec {
+		case "gzip", "br", "zstd", "x-snappy-framed":
+		default:
+			return fmt.Errorf("gin-compress: invalid codec %q for %s", codec, typ)
+		}
+	}
+	if c.DisableGzip && c.DisableBrotli && !c.EnableZstd && !c.EnableSnappy {
+		return fmt.Errorf("gin-compress: all encodings are disabled")
+	}
+	if len(c.ZstdDict) != 0 {
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(c.ZstdDict))
+		if err != nil {
+			return fmt.Errorf("gin-compress: invalid zstd dict: %v", err)
+		}
+		encoder.Close()
+	}
+	return nil
+}
+
+// gzip.HuffmanOnly (-2) gzip.DefaultCompression (-1) 和 0-9
+func validGzipLevel(level int) bool {
+	return level >= gzip.HuffmanOnly && level <= gzip.BestCompression
+}
@@ -0,0 +1,59 @@
+package compress
+
+import (
+	"compress/gzip"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	if err := testConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, level := range []int{gzip.HuffmanOnly, gzip.DefaultCompression, gzip.NoCompression, gzip.BestCompression} {
+		config := testConfig()
+		config.GzipLevel = level
+		if err := config.Validate(); err != nil {
+			t.Fatalf("gzip level %d: %v", level, err)
+		}
+	}
+
+	for name, fn := range map[string]func(*Config){
+		"gzip level":           func(config *Config) { config.GzipLevel = 10 },
+		"gzip level negative":  func(config *Config) { config.GzipLevel = -3 },
+		"brotli quality":       func(config *Config) { config.BrQuality = 12 },
+		"brotli dynamic":       func(config *Config) { config.BrotliMaxQualityForDynamic = 12 },
+		"brotli lgwin":         func(config *Config) { config.BrLGWin = 25 },
+		"zstd level":           func(config *Config) { config.ZstdLevel = 23 },
+		"min length":           func(config *Config) { config.MinLength = -1 },
+		"max buffer bytes":     func(config *Config) { config.MaxBufferBytes = -1 },
+		"adaptive threshold":   func(config *Config) { config.AdaptiveThreshold = -1 },
+		"timeout":              func(config *Config) { config.Timeout = -time.Second },
+		"prewarm pool":         func(config *Config) { config.PrewarmPool = -1 },
+		"max pooled writers":   func(config *Config) { config.MaxPooledWriters = -1 },
+		"zstd dict":            func(config *Config) { config.ZstdDict = []byte("not a dict") },
+		"codec by type":        func(config *Config) { config.CodecByType = map[string]string{"text/html": "deflate"} },
+		"cache control policy": func(config *Config) { config.CacheControlPolicy = "shared" },
+		"all disabled": func(config *Config) {
+			config.DisableGzip = true
+			config.DisableBrotli = true
+		},
+	} {
+		config := testConfig()
+		fn(&config)
+		if err := config.Validate(); err == nil {
+			t.Fatalf("%s: want error", name)
+		}
+	}
+}
+
+func TestCompressPanicsOnInvalidConfig(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("want panic")
+		}
+	}()
+	config := testConfig()
+	config.GzipLevel = 10
+	Compress(config)
+}